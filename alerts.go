@@ -0,0 +1,321 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of the alert rules.
+const (
+	DefaultAlertWindow   = time.Minute
+	DefaultAlertCooldown = 5 * time.Minute
+)
+
+// AlertRule raises an alert when more than Threshold entries at Severity or
+// above, with the Match fields, are logged within Window.
+type AlertRule struct {
+	Name string `yaml:"name"`
+
+	// Severity is DEBUG, INFO, WARNING, ERROR or CRITICAL, all the entries
+	// are counted when empty.
+	Severity string `yaml:"severity"`
+
+	// Match counts only the entries with these fields, compared by their
+	// printed values.
+	Match map[string]string `yaml:"match"`
+
+	// Threshold is the number of entries to exceed, 0 alerts on any entry.
+	// Window defaults to DefaultAlertWindow.
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+
+	// GroupBy counts the entries separately for each value of these fields,
+	// each group raising its own alerts.
+	GroupBy []string `yaml:"group_by"`
+
+	// Cooldown is the minimum time between two alerts of a group, the
+	// config Cooldown when zero.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// AlertsConfig configures an AlertHook. It can be loaded from YAML with
+// LoadAlertsConfig.
+type AlertsConfig struct {
+	Rules []AlertRule `yaml:"rules"`
+
+	// WebhookURL receives a POST request for each alert.
+	WebhookURL string            `yaml:"webhook_url"`
+	Headers    map[string]string `yaml:"headers"`
+
+	// Template is the text/template of the request body, executed with
+	// the Alert. The body is the Alert as JSON when empty. The template
+	// can use the json function to escape values.
+	Template string `yaml:"template"`
+
+	// ContentType defaults to application/json.
+	ContentType string `yaml:"content_type"`
+
+	// Cooldown is the default cooldown of the rules, DefaultAlertCooldown
+	// when zero.
+	Cooldown time.Duration `yaml:"cooldown"`
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client `yaml:"-"`
+
+	// QueueSize is the number of alerts kept while waiting to be sent. The
+	// alerts dropped once it is full are reported on stderr every minute.
+	QueueSize int `yaml:"queue_size"`
+
+	// MaxRetries and RetryBackoff control retries of failed requests.
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// Alert is raised by a rule. Count is the number of matching entries within
+// the window, counted up to Threshold+1.
+type Alert struct {
+	Rule     string            `json:"rule"`
+	Severity string            `json:"severity,omitempty"`
+	Group    map[string]string `json:"group,omitempty"`
+	Count    int               `json:"count"`
+	Window   string            `json:"window"`
+	Message  string            `json:"message"`
+	Time     time.Time         `json:"time"`
+}
+
+// LoadAlertsConfig reads an AlertsConfig from a YAML file.
+func LoadAlertsConfig(path string) (AlertsConfig, error) {
+	var config AlertsConfig
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("epiclogger: invalid alerts config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// AlertHook evaluates the alert rules over the entries and notifies the
+// webhook.
+type AlertHook struct {
+	config   AlertsConfig
+	rules    []*alertRule
+	template *template.Template
+	retry    *retryPolicy
+	batchSink
+}
+
+type alertRule struct {
+	AlertRule
+	minLevel log.Level
+
+	mu        sync.Mutex
+	groups    map[string]*alertGroup
+	lastSweep time.Time
+}
+
+type alertGroup struct {
+	labels    map[string]string
+	times     []time.Time
+	lastAlert time.Time
+}
+
+// NewAlertHook returns a hook evaluating config.Rules. Close it before
+// exiting to send the last alerts.
+func NewAlertHook(config AlertsConfig) (*AlertHook, error) {
+	if config.WebhookURL == "" {
+		return nil, fmt.Errorf("epiclogger: an alerts WebhookURL is required")
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	config.Cooldown = durationOr(config.Cooldown, DefaultAlertCooldown)
+	h := &AlertHook{
+		config: config,
+		retry:  newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	if config.Template != "" {
+		tmpl, err := template.New("alert").Funcs(template.FuncMap{"json": toJSON}).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("epiclogger: invalid alert template: %v", err)
+		}
+		h.template = tmpl
+	}
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("epiclogger: alert rule %d has no name", i)
+		}
+		minLevel, err := severityLevel(rule.Severity)
+		if err != nil {
+			return nil, fmt.Errorf("epiclogger: alert rule %s: %v", rule.Name, err)
+		}
+		rule.Window = durationOr(rule.Window, DefaultAlertWindow)
+		rule.Cooldown = durationOr(rule.Cooldown, config.Cooldown)
+		h.rules = append(h.rules, &alertRule{AlertRule: rule, minLevel: minLevel, groups: map[string]*alertGroup{}})
+	}
+	h.start("alerts", newBatchOptions(1, 0, 0, config.QueueSize), h.send)
+	return h, nil
+}
+
+// severityLevel returns the least severe level of a severity name.
+func severityLevel(severity string) (log.Level, error) {
+	switch strings.ToUpper(severity) {
+	case "":
+		return log.DebugLevel, nil
+	case "CRITICAL":
+		return log.FatalLevel, nil
+	}
+	return log.ParseLevel(strings.ToLower(severity))
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Levels implements logrus.Hook.
+func (h *AlertHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook. Alerts dropped because the queue is full
+// aren't reported as errors, they are counted and reported periodically.
+func (h *AlertHook) Fire(entry *log.Entry) error {
+	for _, rule := range h.rules {
+		alert := rule.evaluate(entry)
+		if alert != nil {
+			h.add(alert, 1)
+		}
+	}
+	// logrus exits or panics right after firing the hooks
+	if entry.Level <= log.FatalLevel {
+		return h.Flush()
+	}
+	return nil
+}
+
+// evaluate counts entry and returns the alert it raises, if any.
+func (r *alertRule) evaluate(entry *log.Entry) *Alert {
+	if entry.Level > r.minLevel {
+		return nil
+	}
+	for k, want := range r.Match {
+		v, ok := entry.Data[k]
+		if !ok || fmt.Sprint(v) != want {
+			return nil
+		}
+	}
+	labels := make(map[string]string, len(r.GroupBy))
+	values := make([]string, len(r.GroupBy))
+	for i, k := range r.GroupBy {
+		if v, ok := entry.Data[k]; ok {
+			labels[k] = fmt.Sprint(v)
+		}
+		values[i] = labels[k]
+	}
+	key := strings.Join(values, "\x00")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= r.Window {
+		r.sweep(now)
+	}
+	group := r.groups[key]
+	if group == nil {
+		group = &alertGroup{labels: labels}
+		r.groups[key] = group
+	}
+	recent := group.times[:0]
+	for _, t := range group.times {
+		if now.Sub(t) < r.Window {
+			recent = append(recent, t)
+		}
+	}
+	// only the last Threshold+1 entries matter
+	if len(recent) > r.Threshold {
+		recent = recent[len(recent)-r.Threshold:]
+	}
+	group.times = append(recent, now)
+	if len(group.times) <= r.Threshold || now.Sub(group.lastAlert) < r.Cooldown {
+		return nil
+	}
+	group.lastAlert = now
+	alert := &Alert{
+		Rule:    r.Name,
+		Count:   len(group.times),
+		Window:  r.Window.String(),
+		Message: entry.Message,
+		Time:    entry.Time,
+	}
+	if r.Severity != "" {
+		alert.Severity = strings.ToUpper(r.Severity)
+	}
+	if len(labels) > 0 {
+		alert.Group = labels
+	}
+	return alert
+}
+
+// sweep removes the groups with no entry within the window and out of their
+// cooldown, which would be created again in the same state, so that groups
+// by request or user IDs don't grow forever.
+func (r *alertRule) sweep(now time.Time) {
+	for key, group := range r.groups {
+		// the times are in order
+		if n := len(group.times); n > 0 && now.Sub(group.times[n-1]) < r.Window {
+			continue
+		}
+		if now.Sub(group.lastAlert) < r.Cooldown {
+			continue
+		}
+		delete(r.groups, key)
+	}
+	r.lastSweep = now
+}
+
+func (h *AlertHook) send(items []interface{}) error {
+	var lastErr error
+	for _, item := range items {
+		alert := item.(*Alert)
+		var body []byte
+		if h.template != nil {
+			var b bytes.Buffer
+			if err := h.template.Execute(&b, alert); err != nil {
+				lastErr = err
+				continue
+			}
+			body = b.Bytes()
+		} else {
+			var err error
+			if body, err = json.Marshal(alert); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		header := http.Header{}
+		for k, v := range h.config.Headers {
+			header.Set(k, v)
+		}
+		header.Set("Content-Type", h.config.ContentType)
+		err := h.retry.do(func() error {
+			_, err := post(h.config.Client, h.config.WebhookURL, body, header)
+			return err
+		})
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,174 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAlertsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "alerts.yaml")
+	ioutil.WriteFile(path, []byte(`
+webhook_url: https://hooks.example.com/alerts
+cooldown: 10m
+headers:
+  Authorization: Bearer secret
+rules:
+  - name: payments-errors
+    severity: ERROR
+    match:
+      service: payments
+    threshold: 10
+    window: 1m
+    group_by: [version]
+  - name: critical
+    severity: CRITICAL
+`), 0600)
+	config, err := LoadAlertsConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hooks.example.com/alerts", config.WebhookURL)
+	assert.Equal(t, 10*time.Minute, config.Cooldown)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret"}, config.Headers)
+	assert.Equal(t, []AlertRule{
+		{Name: "payments-errors", Severity: "ERROR", Match: map[string]string{"service": "payments"}, Threshold: 10, Window: time.Minute, GroupBy: []string{"version"}},
+		{Name: "critical", Severity: "CRITICAL"},
+	}, config.Rules)
+
+	_, err = NewAlertHook(AlertsConfig{WebhookURL: "http://localhost", Rules: []AlertRule{{Name: "bad", Severity: "LOUD"}}})
+	assert.Error(t, err)
+}
+
+func TestAlertHook(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, r.Header.Get("Content-Type")+" "+string(b))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	h, err := NewAlertHook(AlertsConfig{
+		WebhookURL: server.URL,
+		Rules: []AlertRule{
+			{Name: "payments-errors", Severity: "ERROR", Match: map[string]string{"service": "payments"}, Threshold: 2, GroupBy: []string{"region"}},
+			{Name: "critical", Severity: "CRITICAL"},
+		},
+	})
+	assert.NoError(t, err)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(h)
+	payments := logger.WithField("service", "payments")
+	for i := 0; i < 5; i++ {
+		payments.WithField("region", "eu").Error("charge failed")
+	}
+	payments.WithField("region", "us").Error("charge failed")
+	payments.WithField("region", "us").Warn("charge slow")
+	logger.WithField("service", "search").Error("query failed")
+	assert.NoError(t, h.Flush())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, bodies, 1) {
+		var alert Alert
+		assert.NoError(t, json.Unmarshal([]byte(bodies[0][len("application/json "):]), &alert))
+		assert.Equal(t, "payments-errors", alert.Rule)
+		assert.Equal(t, "ERROR", alert.Severity)
+		assert.Equal(t, map[string]string{"region": "eu"}, alert.Group)
+		assert.Equal(t, 3, alert.Count)
+		assert.Equal(t, "1m0s", alert.Window)
+		assert.Equal(t, "charge failed", alert.Message)
+	}
+	assert.NoError(t, h.Close())
+}
+
+func TestAlertHookTemplate(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer server.Close()
+
+	h, err := NewAlertHook(AlertsConfig{
+		WebhookURL: server.URL,
+		Template:   `{"text": {{ json (printf "%s: %s" .Rule .Message) }}}`,
+		Rules:      []AlertRule{{Name: "critical", Severity: "CRITICAL", Cooldown: 50 * time.Millisecond}},
+	})
+	assert.NoError(t, err)
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.PanicLevel
+	entry.Message = `disk "data" gone`
+	assert.NoError(t, h.Fire(entry))
+	// in cooldown
+	assert.NoError(t, h.Fire(entry))
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, h.Fire(entry))
+	assert.NoError(t, h.Close())
+
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, `{"text": "critical: disk \"data\" gone"}`, <-bodies)
+}
+
+func TestAlertHookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	h, err := NewAlertHook(AlertsConfig{
+		WebhookURL: server.URL,
+		QueueSize:  1,
+		Rules:      []AlertRule{{Name: "errors", Severity: "ERROR", GroupBy: []string{"id"}}},
+	})
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		entry := logrus.NewEntry(logrus.New()).WithField("id", i)
+		entry.Level = logrus.ErrorLevel
+		assert.NoError(t, h.Fire(entry))
+	}
+	assert.True(t, atomic.LoadUint64(&h.drops.dropped) > 0)
+	close(release)
+	assert.NoError(t, h.Close())
+}
+
+func TestAlertRuleSweepsIdleGroups(t *testing.T) {
+	rule := &alertRule{
+		AlertRule: AlertRule{Name: "errors", GroupBy: []string{"user"}, Window: 100 * time.Millisecond, Cooldown: 200 * time.Millisecond},
+		minLevel:  logrus.DebugLevel,
+		groups:    map[string]*alertGroup{},
+	}
+	entry := func(user string) *logrus.Entry {
+		e := logrus.NewEntry(logrus.New()).WithField("user", user)
+		e.Level = logrus.ErrorLevel
+		return e
+	}
+	assert.NotNil(t, rule.evaluate(entry("alice")))
+	time.Sleep(120 * time.Millisecond)
+	// alice is idle but in cooldown
+	assert.NotNil(t, rule.evaluate(entry("bob")))
+	assert.Len(t, rule.groups, 2)
+	time.Sleep(120 * time.Millisecond)
+	assert.NotNil(t, rule.evaluate(entry("carol")))
+	assert.Len(t, rule.groups, 2)
+	assert.NotContains(t, rule.groups, "alice")
+	assert.Contains(t, rule.groups, "bob")
+}
@@ -0,0 +1,183 @@
+package epiclogger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// AuditKey is the field set to true on audit entries, to tell them apart
+// from the other entries once collected.
+const AuditKey = "audit"
+
+// Outcomes of audit events.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// AuditEvent is an action recorded for compliance.
+type AuditEvent struct {
+	// Actor and ActorName default to the user id and name read from the
+	// context passed to Audit by the ContextExtractors of the audit
+	// Formatter. Actor is required.
+	Actor     string
+	ActorName string
+
+	// Action, e.g. "user.delete", and Resource, e.g. "users/42", are
+	// required.
+	Action   string
+	Resource string
+
+	// Outcome is AuditSuccess, AuditFailure or AuditDenied. Reason is
+	// required when the outcome isn't a success.
+	Outcome string
+	Reason  string
+
+	// Fields are logged with the event.
+	Fields log.Fields
+}
+
+// AuditConfig configures the sink of the audit events.
+type AuditConfig struct {
+	// Writer receives every event before Record returns. It is synced after
+	// each event when it has a Sync method, like *os.File and
+	// *RotatingFile.
+	Writer io.Writer
+
+	// Formatter formats the events, an EpicFormatter when nil.
+	Formatter log.Formatter
+}
+
+var (
+	auditMu     sync.Mutex
+	auditConfig *AuditConfig
+)
+
+// ConfigureAudit sets the dedicated sink of the audit events. Record fails
+// until it is called: the audit events don't go through the logger, whose
+// hooks may sample or drop them.
+func ConfigureAudit(config AuditConfig) error {
+	if config.Writer == nil {
+		return fmt.Errorf("epiclogger: an audit Writer is required")
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	auditMu.Lock()
+	auditConfig = &config
+	auditMu.Unlock()
+	return nil
+}
+
+// Auditor records the audit events of a request.
+type Auditor struct {
+	ctx context.Context
+}
+
+// Audit returns an Auditor recording the events done on behalf of the
+// author of ctx.
+func Audit(ctx context.Context) *Auditor {
+	return &Auditor{ctx: ctx}
+}
+
+// Record validates event and writes it to the audit sink. Audit events are
+// never sampled nor dropped: an error is returned when it can't be written,
+// or when ConfigureAudit wasn't called.
+func (a *Auditor) Record(event AuditEvent) error {
+	if a.ctx == nil {
+		return fmt.Errorf("epiclogger: can't audit without a context")
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	var formatter log.Formatter
+	if auditConfig != nil {
+		formatter = auditConfig.Formatter
+	}
+	extracted, fieldMap := contextFields(a.ctx, formatter)
+	if id, ok := extracted[fieldMap.resolve(FieldKeyUserID)]; event.Actor == "" && ok {
+		event.Actor = fmt.Sprint(id)
+	}
+	if name, ok := extracted["user"]; event.ActorName == "" && ok {
+		event.ActorName = fmt.Sprint(name)
+	}
+	if err := event.validate(); err != nil {
+		return err
+	}
+
+	fields := log.Fields{}
+	for k, v := range event.Fields {
+		fields[k] = v
+	}
+	fields[AuditKey] = true
+	fields["actor"] = event.Actor
+	fields["action"] = event.Action
+	fields["resource"] = event.Resource
+	fields["outcome"] = event.Outcome
+	if event.ActorName != "" {
+		fields["actor_name"] = event.ActorName
+	}
+	if event.Reason != "" {
+		fields["reason"] = event.Reason
+	}
+	// the formatter extracts the correlation id from the context
+	fields[contextKey] = a.ctx
+	message := fmt.Sprintf("%s %s %s: %s", event.Actor, event.Action, event.Resource, event.Outcome)
+
+	if auditConfig == nil {
+		return fmt.Errorf("epiclogger: no audit sink, call ConfigureAudit")
+	}
+	// not logged through a logger, so that its level and hooks don't apply
+	entry := log.NewEntry(baseLogger.Logger).WithFields(fields)
+	entry.Time = time.Now()
+	entry.Level = log.InfoLevel
+	entry.Message = message
+	b, err := auditConfig.Formatter.Format(entry)
+	if err != nil {
+		return fmt.Errorf("epiclogger: can't format the audit event: %v", err)
+	}
+	w := auditConfig.Writer
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("epiclogger: can't write the audit event: %v", err)
+	}
+	if syncer, ok := w.(interface {
+		Sync() error
+	}); ok {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("epiclogger: can't sync the audit event: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *AuditEvent) validate() error {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"actor", e.Actor},
+		{"action", e.Action},
+		{"resource", e.Resource},
+		{"outcome", e.Outcome},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if e.Outcome != "" && e.Outcome != AuditSuccess && e.Reason == "" {
+		missing = append(missing, "reason")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("epiclogger: invalid audit event, missing %s", strings.Join(missing, ", "))
+	}
+	switch e.Outcome {
+	case AuditSuccess, AuditFailure, AuditDenied:
+		return nil
+	}
+	return fmt.Errorf("epiclogger: invalid audit event, unknown outcome %q", e.Outcome)
+}
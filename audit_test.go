@@ -0,0 +1,107 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// syncedBuffer counts its syncs and fails them on demand.
+type syncedBuffer struct {
+	bytes.Buffer
+	syncs   int
+	syncErr error
+}
+
+func (b *syncedBuffer) Sync() error {
+	b.syncs++
+	return b.syncErr
+}
+
+func TestAuditRecord(t *testing.T) {
+	var sink syncedBuffer
+	assert.NoError(t, ConfigureAudit(AuditConfig{Writer: &sink}))
+	defer func() { auditConfig = nil }()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"author_id", "42", "author_name", "jane", "correlation_id", "abc"))
+	err := Audit(ctx).Record(AuditEvent{
+		Action:   "user.delete",
+		Resource: "users/7",
+		Outcome:  AuditDenied,
+		Reason:   "not an admin",
+		Fields:   logrus.Fields{"ip": "10.0.0.1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sink.syncs)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(sink.Bytes(), &entry))
+	assert.Equal(t, "42 user.delete users/7: denied", entry["message"])
+	assert.Equal(t, "INFO", entry["severity"])
+	for k, v := range map[string]interface{}{
+		"audit":         true,
+		"actor":         "42",
+		"actor_name":    "jane",
+		"action":        "user.delete",
+		"resource":      "users/7",
+		"outcome":       "denied",
+		"reason":        "not an admin",
+		"correlationId": "abc",
+		"ip":            "10.0.0.1",
+	} {
+		assert.Equal(t, v, entry[k], k)
+	}
+
+	sink.syncErr = errors.New("disk full")
+	err = Audit(ctx).Record(AuditEvent{Action: "user.read", Resource: "users/7", Outcome: AuditSuccess})
+	assert.EqualError(t, err, "epiclogger: can't sync the audit event: disk full")
+}
+
+func TestAuditValidation(t *testing.T) {
+	err := Audit(context.Background()).Record(AuditEvent{Action: "user.delete", Outcome: AuditFailure})
+	assert.EqualError(t, err, "epiclogger: invalid audit event, missing actor, resource, reason")
+
+	err = Audit(context.Background()).Record(AuditEvent{Actor: "cron", Action: "purge", Resource: "sessions", Outcome: "maybe", Reason: "?"})
+	assert.EqualError(t, err, `epiclogger: invalid audit event, unknown outcome "maybe"`)
+}
+
+func TestAuditWithoutSink(t *testing.T) {
+	hooks := baseLogger.Logger.Hooks
+	baseLogger.Logger.Hooks = make(logrus.LevelHooks)
+	defer func() { baseLogger.Logger.Hooks = hooks }()
+	hook := test.NewLocal(baseLogger.Logger)
+
+	err := Audit(context.Background()).Record(AuditEvent{Actor: "cron", Action: "purge", Resource: "sessions", Outcome: AuditSuccess})
+	assert.EqualError(t, err, "epiclogger: no audit sink, call ConfigureAudit")
+	assert.Nil(t, hook.LastEntry())
+}
+
+func TestAuditContextExtractors(t *testing.T) {
+	var sink syncedBuffer
+	formatter := &EpicFormatter{
+		ContextExtractors: []ContextExtractor{MetadataField("x-user-id", "uid"), MetadataField("x-user-name", "user")},
+		FieldMap:          FieldMap{FieldKeyUserID: "uid"},
+	}
+	assert.NoError(t, ConfigureAudit(AuditConfig{Writer: &sink, Formatter: formatter}))
+	defer func() { auditConfig = nil }()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user-id", "42", "x-user-name", "jane"))
+	err := Audit(ctx).Record(AuditEvent{Action: "user.read", Resource: "users/7", Outcome: AuditSuccess})
+	assert.NoError(t, err)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(sink.Bytes(), &entry))
+	assert.Equal(t, "42", entry["actor"])
+	assert.Equal(t, "jane", entry["actor_name"])
+
+	err = Audit(nil).Record(AuditEvent{Actor: "cron", Action: "purge", Resource: "sessions", Outcome: AuditSuccess})
+	assert.EqualError(t, err, "epiclogger: can't audit without a context")
+}
@@ -0,0 +1,246 @@
+package epiclogger
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// DefaultBugsnagEndpoint is the Bugsnag notify API URL.
+const DefaultBugsnagEndpoint = "https://notify.bugsnag.com"
+
+// BugsnagConfig configures a BugsnagHook.
+type BugsnagConfig struct {
+	// APIKey is the Bugsnag project API key.
+	APIKey string
+
+	// ReleaseStage is the stage of the running app, e.g. GO_ENV. Nothing is
+	// notified when it is empty, so that an unconfigured machine never
+	// notifies as production.
+	ReleaseStage string
+
+	// NotifyReleaseStages are the release stages that notify Bugsnag,
+	// every stage when empty.
+	NotifyReleaseStages []string
+
+	// AppVersion is reported when the entry has no version field.
+	AppVersion string
+
+	// Endpoint is the notify URL, DefaultBugsnagEndpoint when empty.
+	Endpoint string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// LogLevels are the levels notified, error and above when nil.
+	LogLevels []log.Level
+
+	// Synchronous notifies from the logging goroutine instead of in the
+	// background. Entries at fatal and panic level are always waited for.
+	Synchronous bool
+
+	// QueueSize is the number of events kept in memory while waiting to be
+	// sent, new events are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed notifications.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// BugsnagHook notifies Bugsnag of error entries using the v4 notify API.
+type BugsnagHook struct {
+	config   BugsnagConfig
+	hostname string
+	notify   bool
+	retry    *retryPolicy
+	batchSink
+}
+
+// NewBugsnagHook returns a hook notifying Bugsnag of error entries. Close it
+// before exiting to send the last events.
+func NewBugsnagHook(config BugsnagConfig) (*BugsnagHook, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("epiclogger: a Bugsnag APIKey is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultBugsnagEndpoint
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+	}
+
+	hostname, _ := os.Hostname()
+	h := &BugsnagHook{
+		config:   config,
+		hostname: hostname,
+		notify:   config.ReleaseStage != "" && (len(config.NotifyReleaseStages) == 0 || contains(config.ReleaseStage, config.NotifyReleaseStages)),
+		retry:    newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.start("bugsnag", newBatchOptions(0, 0, time.Second, config.QueueSize), h.send)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *BugsnagHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *BugsnagHook) Fire(entry *log.Entry) error {
+	if !h.notify {
+		return nil
+	}
+	event := h.event(entry)
+	if h.config.Synchronous {
+		return h.send([]interface{}{event})
+	}
+	return h.queue(entry, event, 0)
+}
+
+type bugsnagPayload struct {
+	APIKey   string            `json:"apiKey"`
+	Notifier map[string]string `json:"notifier"`
+	Events   []interface{}     `json:"events"`
+}
+
+type bugsnagEvent struct {
+	Exceptions     []bugsnagException                `json:"exceptions"`
+	Severity       string                            `json:"severity"`
+	SeverityReason map[string]interface{}            `json:"severityReason"`
+	Unhandled      bool                              `json:"unhandled"`
+	Context        string                            `json:"context,omitempty"`
+	App            map[string]string                 `json:"app"`
+	Device         map[string]string                 `json:"device"`
+	User           map[string]string                 `json:"user,omitempty"`
+	Request        map[string]string                 `json:"request,omitempty"`
+	MetaData       map[string]map[string]interface{} `json:"metaData,omitempty"`
+}
+
+type bugsnagException struct {
+	ErrorClass string              `json:"errorClass"`
+	Message    string              `json:"message"`
+	Stacktrace []bugsnagStackFrame `json:"stacktrace"`
+}
+
+type bugsnagStackFrame struct {
+	File       string `json:"file"`
+	LineNumber int    `json:"lineNumber"`
+	Method     string `json:"method"`
+}
+
+func (h *BugsnagHook) send(events []interface{}) error {
+	payload := bugsnagPayload{
+		APIKey: h.config.APIKey,
+		Notifier: map[string]string{
+			"name":    "epic-logger-go",
+			"version": "1.0.0",
+			"url":     "https://github.com/andela/epic-logger-go",
+		},
+		Events: events,
+	}
+	header := http.Header{}
+	header.Set("Bugsnag-Api-Key", h.config.APIKey)
+	header.Set("Bugsnag-Payload-Version", "4")
+	header.Set("Bugsnag-Sent-At", time.Now().UTC().Format(time.RFC3339))
+	return h.retry.do(func() error {
+		_, err := postJSON(h.config.Client, h.config.Endpoint, payload, header)
+		return err
+	})
+}
+
+func bugsnagSeverity(level log.Level) string {
+	switch level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return "error"
+	case log.WarnLevel:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// event maps entry to a Bugsnag event. The user comes from the author_id and
+// author_name metadata of a context passed to WithCtx, the stack from the
+// logrus-stack hook fields and the request from an *http.Request field.
+func (h *BugsnagHook) event(entry *log.Entry) *bugsnagEvent {
+	event := &bugsnagEvent{
+		Severity: bugsnagSeverity(entry.Level),
+		SeverityReason: map[string]interface{}{
+			"type":       "log",
+			"attributes": map[string]string{"level": entry.Level.String()},
+		},
+		Unhandled: entry.Level <= log.FatalLevel,
+		App:       map[string]string{"releaseStage": h.config.ReleaseStage},
+		Device:    map[string]string{"hostname": h.hostname},
+		MetaData:  map[string]map[string]interface{}{},
+	}
+
+	exception := bugsnagException{ErrorClass: "log." + entry.Level.String(), Message: entry.Message}
+	fields := map[string]interface{}{}
+	for k, v := range entry.Data {
+		switch x := v.(type) {
+		case error:
+			exception.ErrorClass = fmt.Sprintf("%T", x)
+			exception.Message = entry.Message + ": " + x.Error()
+		case stack.Stack:
+			for _, frame := range x {
+				exception.Stacktrace = append(exception.Stacktrace, bugsnagStackFrame{File: frame.File, LineNumber: frame.Line, Method: frame.Name})
+			}
+		case stack.Frame:
+			event.Context = x.Name
+		case *http.Request:
+			event.Request = map[string]string{
+				"httpMethod": x.Method,
+				"url":        x.URL.String(),
+				"referer":    x.Referer(),
+				"clientIp":   x.RemoteAddr,
+			}
+		case context.Context:
+			extracted, fieldMap := contextFields(x, entry.Logger.Formatter)
+			user := map[string]string{}
+			userKey := fieldMap.resolve(FieldKeyUserID)
+			if id, ok := extracted[userKey]; ok {
+				user["id"] = fmt.Sprint(id)
+				delete(extracted, userKey)
+			}
+			if name, ok := extracted["user"]; ok {
+				user["name"] = fmt.Sprint(name)
+				delete(extracted, "user")
+			}
+			if len(user) > 0 {
+				event.User = user
+			}
+			for key, value := range extracted {
+				fields[key] = defaultFieldEncoder.Encode(value)
+			}
+		default:
+			if k == "version" {
+				event.App["version"] = fmt.Sprint(v)
+			}
+			fields[k] = defaultFieldEncoder.Encode(v)
+		}
+	}
+	if event.App["version"] == "" {
+		event.App["version"] = h.config.AppVersion
+	}
+	if len(exception.Stacktrace) == 0 {
+		if caller, ok := entry.Data["caller"].(stack.Frame); ok {
+			exception.Stacktrace = []bugsnagStackFrame{{File: caller.File, LineNumber: caller.Line, Method: caller.Name}}
+		}
+	}
+	// the API rejects exceptions without a stacktrace
+	if exception.Stacktrace == nil {
+		exception.Stacktrace = []bugsnagStackFrame{}
+	}
+	event.Exceptions = []bugsnagException{exception}
+	if len(fields) > 0 {
+		event.MetaData["fields"] = fields
+	}
+	return event
+}
@@ -0,0 +1,145 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func newFakeBugsnag(t *testing.T) (*httptest.Server, func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "api-key", r.Header.Get("Bugsnag-Api-Key"))
+		assert.Equal(t, "4", r.Header.Get("Bugsnag-Payload-Version"))
+		var payload struct {
+			Events []map[string]interface{} `json:"events"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		mu.Lock()
+		events = append(events, payload.Events...)
+		mu.Unlock()
+	}))
+	return server, func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+}
+
+func TestBugsnagHook(t *testing.T) {
+	server, events := newFakeBugsnag(t)
+	defer server.Close()
+
+	hook, err := NewBugsnagHook(BugsnagConfig{APIKey: "api-key", ReleaseStage: "staging", Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"author_id", "this_author_id",
+		"author_name", "this_author_name",
+	))
+	req, _ := http.NewRequest("GET", "http://example.com/path", nil)
+	logger.Info("not notified")
+	logger.WithCtx(ctx).WithField("request", req).WithError(errors.New("boom")).Error("failed")
+	assert.NoError(t, hook.Close())
+
+	assert.Equal(t, 1, len(events()))
+	event := events()[0]
+	assert.Equal(t, "error", event["severity"])
+	assert.Equal(t, map[string]interface{}{"id": "this_author_id", "name": "this_author_name"}, event["user"])
+	assert.Equal(t, "http://example.com/path", event["request"].(map[string]interface{})["url"])
+	assert.Equal(t, "staging", event["app"].(map[string]interface{})["releaseStage"])
+	exception := event["exceptions"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "failed: boom", exception["message"])
+}
+
+func TestBugsnagContextExtractors(t *testing.T) {
+	server, events := newFakeBugsnag(t)
+	defer server.Close()
+
+	hook, err := NewBugsnagHook(BugsnagConfig{APIKey: "api-key", ReleaseStage: "production", Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Formatter = &EpicFormatter{ContextExtractors: []ContextExtractor{
+		MetadataField("x-user-id", "userId"),
+		MetadataField("x-request-id", "requestId"),
+	}}
+	logger.Logger.Hooks.Add(hook)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user-id", "42", "x-request-id", "req-1"))
+	logger.WithCtx(ctx).Error("failed")
+	assert.NoError(t, hook.Close())
+
+	if assert.Equal(t, 1, len(events())) {
+		event := events()[0]
+		assert.Equal(t, map[string]interface{}{"id": "42"}, event["user"])
+		assert.Equal(t, "req-1", event["metaData"].(map[string]interface{})["fields"].(map[string]interface{})["requestId"])
+	}
+}
+
+func TestBugsnagAppVersion(t *testing.T) {
+	server, events := newFakeBugsnag(t)
+	defer server.Close()
+
+	hook, err := NewBugsnagHook(BugsnagConfig{APIKey: "api-key", ReleaseStage: "production", AppVersion: "2.0.0", Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(hook)
+	logger.WithField("version", "1.2.3").Error("versioned")
+	logger.Error("unversioned")
+	assert.NoError(t, hook.Close())
+
+	if assert.Equal(t, 2, len(events())) {
+		assert.Equal(t, "1.2.3", events()[0]["app"].(map[string]interface{})["version"])
+		assert.Equal(t, "2.0.0", events()[1]["app"].(map[string]interface{})["version"])
+	}
+}
+
+func TestBugsnagReleaseStageFilter(t *testing.T) {
+	server, events := newFakeBugsnag(t)
+	defer server.Close()
+
+	hook, err := NewBugsnagHook(BugsnagConfig{
+		APIKey:              "api-key",
+		ReleaseStage:        "development",
+		NotifyReleaseStages: []string{"production"},
+		Endpoint:            server.URL,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	logger.Error("not notified in development")
+	assert.NoError(t, hook.Close())
+	assert.Equal(t, 0, len(events()))
+}
+
+func TestBugsnagUnknownReleaseStage(t *testing.T) {
+	server, events := newFakeBugsnag(t)
+	defer server.Close()
+
+	hooks := baseLogger.Logger.Hooks
+	baseLogger.Logger.Hooks = make(logrus.LevelHooks)
+	defer func() { baseLogger.Logger.Hooks = hooks }()
+	integrations, err := Configure(Options{Bugsnag: &BugsnagConfig{APIKey: "api-key", Endpoint: server.URL}})
+	assert.NoError(t, err)
+	assert.NotNil(t, integrations.Bugsnag)
+
+	Error("not notified without a release stage")
+	assert.NoError(t, integrations.Close())
+	assert.Equal(t, 0, len(events()))
+}
@@ -0,0 +1,204 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	logging "google.golang.org/api/logging/v2beta1"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultCloudLoggingEndpoint is the Cloud Logging API base URL.
+const DefaultCloudLoggingEndpoint = "https://logging.googleapis.com"
+
+// CloudLoggingConfig configures a CloudLoggingHook.
+type CloudLoggingConfig struct {
+	// ProjectID is the Google Cloud project the entries are written to.
+	ProjectID string
+
+	// LogName is the log the entries are written to, "epic-logger" by default.
+	LogName string
+
+	// Resource is the monitored resource the entries belong to, the "global"
+	// resource by default.
+	Resource *logging.MonitoredResource
+
+	// Labels are added to every entry, along with the service and version.
+	Labels map[string]string
+
+	// Endpoint is the API base URL, DefaultCloudLoggingEndpoint when empty.
+	Endpoint string
+
+	// Client sends the requests. It must add the credentials, e.g. a client
+	// from golang.org/x/oauth2/google.DefaultClient. http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter builds the jsonPayload of the entries.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels sent to Cloud Logging, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound how long entries wait
+	// before being written, see the Default* constants.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// written, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed writes.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// CloudLoggingHook writes entries straight to the Cloud Logging entries:write
+// API, for hosts that don't run a logging agent.
+type CloudLoggingHook struct {
+	config  CloudLoggingConfig
+	url     string
+	logName string
+	retry   *retryPolicy
+	batchSink
+}
+
+// NewCloudLoggingHook returns a hook sending entries to Cloud Logging in the
+// background. Close it before exiting to flush the last entries.
+func NewCloudLoggingHook(config CloudLoggingConfig) (*CloudLoggingHook, error) {
+	if config.ProjectID == "" {
+		return nil, fmt.Errorf("epiclogger: a ProjectID is required")
+	}
+	if config.LogName == "" {
+		config.LogName = "epic-logger"
+	}
+	if config.Resource == nil {
+		config.Resource = &logging.MonitoredResource{Type: "global"}
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultCloudLoggingEndpoint
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+
+	h := &CloudLoggingHook{
+		config:  config,
+		url:     strings.TrimSuffix(config.Endpoint, "/") + "/v2beta1/entries:write",
+		logName: "projects/" + config.ProjectID + "/logs/" + url.PathEscape(config.LogName),
+		retry:   newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.start("cloud logging", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.write)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *CloudLoggingHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook. The entry is queued, not sent.
+func (h *CloudLoggingHook) Fire(entry *log.Entry) error {
+	logEntry, err := h.logEntry(entry)
+	if err != nil {
+		return err
+	}
+	return h.queue(entry, logEntry, len(logEntry.JsonPayload)+512)
+}
+
+func (h *CloudLoggingHook) write(items []interface{}) error {
+	entries := make([]*logging.LogEntry, len(items))
+	for i, item := range items {
+		entries[i] = item.(*logging.LogEntry)
+	}
+	req := &logging.WriteLogEntriesRequest{
+		LogName:        h.logName,
+		Resource:       h.config.Resource,
+		Labels:         h.config.Labels,
+		Entries:        entries,
+		PartialSuccess: true,
+	}
+	return h.retry.do(func() error {
+		_, err := postJSON(h.config.Client, h.url, req, nil)
+		return err
+	})
+}
+
+// logEntry converts entry to a Cloud Logging LogEntry, with the EpicFormatter
+// payload as jsonPayload.
+func (h *CloudLoggingHook) logEntry(entry *log.Entry) (*logging.LogEntry, error) {
+	f := h.config.Formatter
+	data, httpReq, err := f.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	logEntry := &logging.LogEntry{
+		Timestamp:   entry.Time.Format(time.RFC3339Nano),
+		Severity:    getSeverity(entry.Level),
+		HttpRequest: httpReq,
+		Labels:      map[string]string{},
+		Trace:       h.trace(entry, data),
+	}
+	for _, k := range []string{"service", "version"} {
+		if v, ok := data[k].(string); ok {
+			logEntry.Labels[k] = v
+		}
+	}
+	if caller, ok := entry.Data["caller"].(stack.Frame); ok {
+		logEntry.SourceLocation = &logging.LogEntrySourceLocation{
+			File:     caller.File,
+			Function: caller.Name,
+			Line:     int64(caller.Line),
+		}
+	}
+
+	payload := f.preparePayload(entry, data, httpReq)
+	// these have their own LogEntry fields
+	delete(payload, f.FieldMap.resolve(FieldKeyTime))
+	delete(payload, f.FieldMap.resolve(FieldKeySeverity))
+	delete(payload, f.FieldMap.resolve(FieldKeyHTTPRequest))
+	serialized, err := f.marshalWithinBudget(payload)
+	if err != nil {
+		serialized, err = json.Marshal(f.fallbackPayload(entry, data, err))
+		if err != nil {
+			return nil, err
+		}
+	}
+	logEntry.JsonPayload = googleapi.RawMessage(serialized)
+	return logEntry, nil
+}
+
+// trace returns the trace of the entry, taken from a "trace" field or from
+// the X-Cloud-Trace-Context header forwarded in the gRPC metadata.
+func (h *CloudLoggingHook) trace(entry *log.Entry, data log.Fields) string {
+	traceID, _ := data["trace"].(string)
+	if traceID == "" {
+		for _, v := range entry.Data {
+			ctx, ok := v.(context.Context)
+			if !ok {
+				continue
+			}
+			md, _ := metadata.FromContext(ctx)
+			if values := md["x-cloud-trace-context"]; len(values) > 0 {
+				traceID = strings.SplitN(values[0], "/", 2)[0]
+			}
+		}
+	}
+	if traceID == "" || strings.HasPrefix(traceID, "projects/") {
+		return traceID
+	}
+	return "projects/" + h.config.ProjectID + "/traces/" + traceID
+}
@@ -0,0 +1,111 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	logging "google.golang.org/api/logging/v2beta1"
+	"google.golang.org/grpc/metadata"
+)
+
+type fakeCloudLogging struct {
+	sync.Mutex
+	requests []logging.WriteLogEntriesRequest
+	failures int
+}
+
+func (f *fakeCloudLogging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Path != "/v2beta1/entries:write" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var req logging.WriteLogEntriesRequest
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, req)
+	w.Write([]byte("{}"))
+}
+
+func (f *fakeCloudLogging) entries() []*logging.LogEntry {
+	f.Lock()
+	defer f.Unlock()
+	var entries []*logging.LogEntry
+	for _, req := range f.requests {
+		entries = append(entries, req.Entries...)
+	}
+	return entries
+}
+
+func TestCloudLoggingHook(t *testing.T) {
+	fake := &fakeCloudLogging{failures: 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	hook, err := NewCloudLoggingHook(CloudLoggingConfig{
+		ProjectID:    "my-project",
+		Endpoint:     server.URL,
+		BatchCount:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-cloud-trace-context", "abc123/1;o=1"))
+	logger.WithFields(map[string]interface{}{"service": "svc", "version": "1"}).WithCtx(ctx).Info("first")
+	logger.WithField("answer", 42).Warn("second")
+	logger.Info("third")
+	assert.NoError(t, hook.Close())
+
+	entries := fake.entries()
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, 2, len(fake.requests), "entries should be batched by two")
+	assert.Equal(t, "projects/my-project/logs/epic-logger", fake.requests[0].LogName)
+
+	assert.Equal(t, "INFO", entries[0].Severity)
+	assert.Equal(t, "svc", entries[0].Labels["service"])
+	assert.Equal(t, "projects/my-project/traces/abc123", entries[0].Trace)
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(entries[0].JsonPayload, &payload))
+	assert.Equal(t, "first", payload["message"])
+	assert.Nil(t, payload["severity"])
+
+	assert.Equal(t, "WARNING", entries[1].Severity)
+}
+
+func TestCloudLoggingHookGivesUpOnPermanentErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	hook, err := NewCloudLoggingHook(CloudLoggingConfig{ProjectID: "my-project", Endpoint: server.URL, RetryBackoff: time.Millisecond})
+	assert.NoError(t, err)
+	logger := NewEpicLogger(ioutil.Discard)
+	entry := logger.WithField("a", 1).Entry
+	entry.Level = logrus.InfoLevel
+	assert.NoError(t, hook.Fire(entry))
+	assert.Error(t, hook.Flush())
+	assert.Equal(t, 1, calls)
+	hook.Close()
+}
@@ -0,0 +1,102 @@
+package epiclogger
+
+import (
+	"fmt"
+	"strings"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// ContextExtractor adds fields read from a context passed to WithCtx.
+type ContextExtractor interface {
+	Extract(ctx context.Context, fields log.Fields)
+}
+
+// ContextExtractorFunc is an adapter to use ordinary functions as
+// ContextExtractors.
+type ContextExtractorFunc func(ctx context.Context, fields log.Fields)
+
+// Extract calls fn(ctx, fields).
+func (fn ContextExtractorFunc) Extract(ctx context.Context, fields log.Fields) {
+	fn(ctx, fields)
+}
+
+// loggerContext is a context logged by an EpicLogger with its own
+// ContextExtractors.
+type loggerContext struct {
+	context.Context
+	extractors []ContextExtractor
+}
+
+// contextFields returns the fields read from ctx by the ContextExtractors of
+// formatter, the default ones unless it is an EpicFormatter or an
+// ECSFormatter, and the FieldMap telling where the user and correlation ids
+// were put.
+func contextFields(ctx context.Context, formatter log.Formatter) (log.Fields, FieldMap) {
+	epic, ok := formatter.(*EpicFormatter)
+	if ecs, isECS := formatter.(*ECSFormatter); isECS && ecs.Formatter != nil {
+		epic, ok = ecs.Formatter, true
+	}
+	if !ok || epic == nil {
+		epic = &EpicFormatter{}
+	}
+	return epic.extractContext(ctx), epic.FieldMap
+}
+
+// MetadataField logs the first value of the gRPC metadata key as field.
+func MetadataField(key, field string) ContextExtractor {
+	key = strings.ToLower(key)
+	return ContextExtractorFunc(func(ctx context.Context, fields log.Fields) {
+		md, _ := metadata.FromContext(ctx)
+		if values := md[key]; len(values) > 0 {
+			fields[field] = values[0]
+		}
+	})
+}
+
+// MetadataPrefix logs every gRPC metadata key starting with prefix, e.g.
+// "x-tenant-", under its own name.
+func MetadataPrefix(prefix string) ContextExtractor {
+	prefix = strings.ToLower(prefix)
+	return ContextExtractorFunc(func(ctx context.Context, fields log.Fields) {
+		md, _ := metadata.FromContext(ctx)
+		for key, values := range md {
+			if strings.HasPrefix(key, prefix) && len(values) > 0 {
+				fields[key] = values[0]
+			}
+		}
+	})
+}
+
+// ContextValue logs ctx.Value(key) as field when it is set.
+func ContextValue(key interface{}, field string) ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, fields log.Fields) {
+		if value := ctx.Value(key); value != nil {
+			fields[field] = value
+		}
+	})
+}
+
+// GRPCTags logs the tags set by the go-grpc-middleware ctxtags interceptor.
+func GRPCTags() ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, fields log.Fields) {
+		for key, value := range grpc_ctxtags.Extract(ctx).Values() {
+			fields[key] = fmt.Sprintf("%v", value)
+		}
+	})
+}
+
+// DefaultContextExtractors returns the extractors used when a formatter has
+// none configured: the author and correlation id metadata set by our gateways,
+// and the gRPC tags. fieldMap renames the userId and correlationId fields.
+func DefaultContextExtractors(fieldMap FieldMap) []ContextExtractor {
+	return []ContextExtractor{
+		MetadataField("author_id", fieldMap.resolve(FieldKeyUserID)),
+		MetadataField("author_name", "user"),
+		MetadataField("correlation_id", fieldMap.resolve(FieldKeyCorrelationID)),
+		GRPCTags(),
+	}
+}
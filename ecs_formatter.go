@@ -0,0 +1,120 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+)
+
+// ECSVersion is the Elastic Common Schema version of ECSFormatter documents.
+const ECSVersion = "1.12.0"
+
+// ECSFormatter formats entries as Elastic Common Schema JSON documents.
+// The fields EpicFormatter writes for Stackdriver are mapped to their ECS
+// counterparts, the other fields are kept as they are.
+type ECSFormatter struct {
+	// Formatter collects the fields like the JSON output does, its FieldMap
+	// tells where the user id is.
+	Formatter *EpicFormatter
+}
+
+// Format the log entry. Implements logrus.Formatter.
+func (f *ECSFormatter) Format(entry *log.Entry) ([]byte, error) {
+	doc, err := f.FormatMap(entry)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+	}
+	return append(serialized, '\n'), nil
+}
+
+// FormatMap returns the ECS document of entry.
+func (f *ECSFormatter) FormatMap(entry *log.Entry) (map[string]interface{}, error) {
+	formatter := f.Formatter
+	if formatter == nil {
+		formatter = &EpicFormatter{}
+	}
+	data, httpReq, err := formatter.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	for k, v := range data {
+		doc[k] = v
+	}
+	move := func(field, path string) {
+		if v, ok := doc[field]; ok {
+			delete(doc, field)
+			setPath(doc, path, v)
+		}
+	}
+	move("service", "service.name")
+	move("version", "service.version")
+	move("user", "user.name")
+	move(formatter.FieldMap.resolve(FieldKeyUserID), "user.id")
+	move(log.ErrorKey, "error.message")
+
+	switch x := doc["stack"].(type) {
+	case stack.Stack:
+		delete(doc, "stack")
+		setPath(doc, "error.stack_trace", x.String())
+	case string:
+		delete(doc, "stack")
+		setPath(doc, "error.stack_trace", x)
+	}
+	if caller, ok := doc["caller"].(stack.Frame); ok {
+		delete(doc, "caller")
+		setPath(doc, "log.origin.file.name", caller.File)
+		setPath(doc, "log.origin.file.line", caller.Line)
+		setPath(doc, "log.origin.function", caller.Name)
+	}
+	if httpReq != nil {
+		delete(doc, "grpc.method")
+		setPath(doc, "http.request.method", httpReq.RequestMethod)
+		setPath(doc, "url.full", httpReq.RequestUrl)
+		if httpReq.Referer != "" {
+			setPath(doc, "http.request.referrer", httpReq.Referer)
+		}
+		if httpReq.Status != 0 {
+			setPath(doc, "http.response.status_code", httpReq.Status)
+		}
+		if httpReq.ResponseSize != 0 {
+			setPath(doc, "http.response.body.bytes", httpReq.ResponseSize)
+		}
+		if httpReq.UserAgent != "" {
+			setPath(doc, "user_agent.original", httpReq.UserAgent)
+		}
+		if httpReq.RemoteIp != "" {
+			setPath(doc, "client.address", httpReq.RemoteIp)
+		}
+	}
+
+	doc["@timestamp"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	doc["message"] = entry.Message
+	setPath(doc, "log.level", getSeverity(entry.Level))
+	setPath(doc, "ecs.version", ECSVersion)
+	return doc, nil
+}
+
+// setPath sets a dotted ECS path as nested objects. A scalar found on the
+// way is replaced.
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+}
@@ -0,0 +1,54 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/stack"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestECSFormatter(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/orders", nil)
+	req.Header.Set("User-Agent", "curl")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("author_id", "42"))
+	entry := logrus.WithFields(logrus.Fields{
+		"service": "api",
+		"version": "1.2",
+		"context": ctx,
+		"request": req,
+		"error":   errors.New("boom"),
+		"stack":   "main.go:10",
+		"caller":  stack.Frame{File: "main.go", Line: 10, Name: "main.run"},
+		"custom":  "kept",
+	})
+	entry.Level = logrus.ErrorLevel
+	entry.Time = time.Date(2018, 3, 4, 5, 6, 7, 8, time.UTC)
+	entry.Message = "order failed"
+
+	b, err := (&ECSFormatter{}).Format(entry)
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &doc))
+
+	assert.Equal(t, "2018-03-04T05:06:07.000000008Z", doc["@timestamp"])
+	assert.Equal(t, "order failed", doc["message"])
+	assert.Equal(t, map[string]interface{}{
+		"level":  "ERROR",
+		"origin": map[string]interface{}{"file": map[string]interface{}{"name": "main.go", "line": float64(10)}, "function": "main.run"},
+	}, doc["log"])
+	assert.Equal(t, map[string]interface{}{"name": "api", "version": "1.2"}, doc["service"])
+	assert.Equal(t, map[string]interface{}{"id": "42"}, doc["user"])
+	assert.Equal(t, map[string]interface{}{"message": "boom", "stack_trace": "main.go:10"}, doc["error"])
+	assert.Equal(t, map[string]interface{}{"method": "POST"}, doc["http"].(map[string]interface{})["request"])
+	assert.Equal(t, map[string]interface{}{"full": "http://example.com/orders"}, doc["url"])
+	assert.Equal(t, map[string]interface{}{"original": "curl"}, doc["user_agent"])
+	assert.Equal(t, "kept", doc["custom"])
+	assert.Nil(t, doc["severity"])
+}
@@ -0,0 +1,215 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the Elasticsearch sink.
+const (
+	DefaultElasticsearchIndex = "epiclogger"
+	DefaultIndexDateFormat    = "2006.01.02"
+)
+
+// ElasticsearchConfig configures an ElasticsearchHook. It works with
+// OpenSearch too.
+type ElasticsearchConfig struct {
+	// URL is the cluster URL, the entries are sent to URL/_bulk.
+	URL string
+
+	// Username and Password are sent with basic auth, APIKey as an
+	// "Authorization: ApiKey" header.
+	Username string
+	Password string
+	APIKey   string
+
+	// Index is the index name prefix, DefaultElasticsearchIndex when empty.
+	// Entries go to daily indices named Index-<date> after the entry time
+	// in UTC, formatted with IndexDateFormat (DefaultIndexDateFormat when
+	// empty).
+	Index           string
+	IndexDateFormat string
+
+	// ECS indexes ECSFormatter documents instead of EpicFormatter ones.
+	ECS bool
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter collects the fields of the documents.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels indexed, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound the bulk requests.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// indexed, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed requests and of
+	// the items rejected with a retryable status.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// ElasticsearchHook indexes entries with the _bulk API.
+type ElasticsearchHook struct {
+	config ElasticsearchConfig
+	url    string
+	ecs    *ECSFormatter
+	retry  *retryPolicy
+	batchSink
+}
+
+type bulkItem struct {
+	index string
+	doc   []byte
+}
+
+// NewElasticsearchHook returns a hook indexing entries in the background.
+// Close it before exiting to index the last entries.
+func NewElasticsearchHook(config ElasticsearchConfig) (*ElasticsearchHook, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("epiclogger: an Elasticsearch URL is required")
+	}
+	if config.Index == "" {
+		config.Index = DefaultElasticsearchIndex
+	}
+	if config.IndexDateFormat == "" {
+		config.IndexDateFormat = DefaultIndexDateFormat
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	h := &ElasticsearchHook{
+		config: config,
+		url:    strings.TrimSuffix(config.URL, "/") + "/_bulk",
+		ecs:    &ECSFormatter{Formatter: config.Formatter},
+		retry:  newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.start("elasticsearch", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.bulk)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *ElasticsearchHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *ElasticsearchHook) Fire(entry *log.Entry) error {
+	var doc map[string]interface{}
+	var err error
+	if h.config.ECS {
+		doc, err = h.ecs.FormatMap(entry)
+	} else {
+		doc, err = h.config.Formatter.FormatMap(entry)
+	}
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	item := &bulkItem{
+		index: h.config.Index + "-" + entry.Time.UTC().Format(h.config.IndexDateFormat),
+		doc:   serialized,
+	}
+	return h.queue(entry, item, len(serialized))
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk indexes the items. Items rejected with a retryable status (429, 5xx)
+// are sent again, the others are dropped and reported.
+func (h *ElasticsearchHook) bulk(values []interface{}) error {
+	items := make([]*bulkItem, len(values))
+	for i, v := range values {
+		items[i] = v.(*bulkItem)
+	}
+	total := len(items)
+	var lastErr error
+	var dropped int
+	err := h.retry.do(func() error {
+		var body bytes.Buffer
+		for _, item := range items {
+			fmt.Fprintf(&body, `{"index":{"_index":%q}}`+"\n", item.index)
+			body.Write(item.doc)
+			body.WriteByte('\n')
+		}
+		respBody, err := post(h.config.Client, h.url, body.Bytes(), h.header())
+		if err != nil {
+			return err
+		}
+		var resp bulkResponse
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return fmt.Errorf("invalid _bulk response: %v", err)
+		}
+		if !resp.Errors {
+			return nil
+		}
+
+		var retry []*bulkItem
+		for i, result := range resp.Items {
+			for _, r := range result {
+				if r.Status < 300 || i >= len(items) {
+					continue
+				}
+				statusErr := &StatusError{StatusCode: r.Status, Body: string(r.Error)}
+				if statusErr.Temporary() {
+					retry = append(retry, items[i])
+				} else {
+					dropped++
+					lastErr = statusErr
+				}
+			}
+		}
+		items = retry
+		if len(retry) > 0 {
+			return fmt.Errorf("%d items rejected", len(retry))
+		}
+		return nil
+	})
+	if err != nil {
+		dropped += len(items)
+		lastErr = err
+	}
+	if dropped > 0 {
+		return &partialError{dropped: dropped, total: total, err: lastErr}
+	}
+	return nil
+}
+
+func (h *ElasticsearchHook) header() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ndjson")
+	if h.config.APIKey != "" {
+		header.Set("Authorization", "ApiKey "+h.config.APIKey)
+	} else if h.config.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.config.Username + ":" + h.config.Password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+	return header
+}
@@ -0,0 +1,65 @@
+package epiclogger
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElasticsearchHook(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "ApiKey secret", r.Header.Get("Authorization"))
+		var lines []map[string]interface{}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+		mu.Lock()
+		requests = append(requests, lines)
+		first := len(requests) == 1
+		mu.Unlock()
+		if first {
+			// the second item is retried, the third dropped
+			w.Write([]byte(`{"errors":true,"items":[
+				{"index":{"status":201}},
+				{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+				{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	hook, err := NewElasticsearchHook(ElasticsearchConfig{URL: server.URL, APIKey: "secret", Index: "logs", RetryBackoff: time.Millisecond})
+	assert.NoError(t, err)
+	day := time.Date(2018, 3, 4, 23, 0, 0, 0, time.UTC)
+	for _, message := range []string{"indexed", "retried", "rejected"} {
+		entry := logrus.NewEntry(logrus.StandardLogger())
+		entry.Level = logrus.InfoLevel
+		entry.Time = day
+		entry.Message = message
+		assert.NoError(t, hook.Fire(entry))
+	}
+	err = hook.Flush()
+	assert.Equal(t, 1, err.(*partialError).dropped)
+	hook.Close()
+
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, 6, len(requests[0]))
+	assert.Equal(t, map[string]interface{}{"_index": "logs-2018.03.04"}, requests[0][0]["index"])
+	assert.Equal(t, "indexed", requests[0][1]["message"])
+	assert.Equal(t, 2, len(requests[1]))
+	assert.Equal(t, "retried", requests[1][1]["message"])
+}
@@ -0,0 +1,355 @@
+package epiclogger
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultMaxDepth is the nesting depth after which the FieldEncoder stops
+// descending into a value.
+const DefaultMaxDepth = 10
+
+const (
+	redactedValue = "[REDACTED]"
+	cycleValue    = "[cycle]"
+	maxDepthValue = "[max depth]"
+)
+
+// LogValuer is implemented by types that want to replace themselves with a
+// different value when they are logged, e.g. to hide secrets or to log only an ID.
+type LogValuer interface {
+	LogValue() interface{}
+}
+
+// ObjectMarshaler is implemented by types that want full control over the
+// fields they log.
+type ObjectMarshaler interface {
+	MarshalLogObject(ObjectEncoder) error
+}
+
+// ObjectEncoder collects the fields added by an ObjectMarshaler.
+type ObjectEncoder interface {
+	AddField(key string, value interface{})
+}
+
+// FieldEncoder turns arbitrary field values into maps, slices and scalars
+// that can be safely serialized by EpicFormatter and TextFormatter.
+//
+// time.Time is rendered as RFC3339, time.Duration and fmt.Stringer as strings,
+// []byte as base64 and proto messages with protojson. Values encoding/json
+// cannot handle (NaN, Inf, channels, funcs, cycles) are replaced by a string.
+//
+// Struct fields are named and controlled by the `log` struct tag:
+//
+//	type User struct {
+//		ID       string  `log:"id"`
+//		Password string  `log:"password,redact"`
+//		Nick     string  `log:"nick,omitempty"`
+//		Address  Address `log:",inline"`
+//		Internal string  `log:"-"`
+//	}
+//
+// When there is no `log` tag the `json` tag name is used, so structs that are
+// already shaped for encoding/json keep their field names.
+type FieldEncoder struct {
+	// MaxDepth is the maximum nesting depth, DefaultMaxDepth when zero.
+	MaxDepth int
+
+	fieldsCache sync.Map // map[reflect.Type][]structField
+}
+
+var defaultFieldEncoder = &FieldEncoder{}
+
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+	redact    bool
+	inline    bool
+}
+
+// Encode returns the log representation of v.
+func (e *FieldEncoder) Encode(v interface{}) interface{} {
+	encoded, _ := e.Normalize(v)
+	return encoded
+}
+
+// Normalize returns the log representation of v along with a note for every
+// value that could not be represented as-is (NaN, channels, cycles, failing
+// marshalers...) and was replaced with a placeholder.
+func (e *FieldEncoder) Normalize(v interface{}) (interface{}, []string) {
+	state := &encodeState{encoder: e, seen: map[uintptr]bool{}}
+	return state.encode(v, 0), state.notes
+}
+
+func (e *FieldEncoder) maxDepth() int {
+	if e.MaxDepth > 0 {
+		return e.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+type encodeState struct {
+	encoder *FieldEncoder
+	seen    map[uintptr]bool
+	notes   []string
+}
+
+func (s *encodeState) note(format string, args ...interface{}) {
+	s.notes = append(s.notes, fmt.Sprintf(format, args...))
+}
+
+func (s *encodeState) encode(v interface{}, depth int) interface{} {
+	if v == nil {
+		return nil
+	}
+	if depth >= s.encoder.maxDepth() {
+		return maxDepthValue
+	}
+	// before the interfaces, whose methods may not accept a nil receiver
+	rv := reflect.ValueOf(v)
+	if isNilPointer(rv) {
+		return nil
+	}
+
+	switch x := v.(type) {
+	case ObjectMarshaler:
+		enc := &mapObjectEncoder{state: s, depth: depth + 1, fields: map[string]interface{}{}}
+		if err := x.MarshalLogObject(enc); err != nil {
+			enc.fields["logMarshalError"] = err.Error()
+			s.note("%T: %v", v, err)
+		}
+		return enc.fields
+	case LogValuer:
+		return s.encode(x.LogValue(), depth+1)
+	case error:
+		return x.Error()
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case time.Duration:
+		return x.String()
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	case proto.Message:
+		b, err := protojson.Marshal(x)
+		if err != nil {
+			s.note("%T: %v", v, err)
+			return fmt.Sprintf("%v", x)
+		}
+		return json.RawMessage(b)
+	case json.Marshaler:
+		b, err := x.MarshalJSON()
+		if err != nil || !json.Valid(b) {
+			s.note("%T: invalid MarshalJSON output: %v", v, err)
+			return fmt.Sprintf("%+v", x)
+		}
+		return json.RawMessage(b)
+	case encoding.TextMarshaler:
+		b, err := x.MarshalText()
+		if err != nil {
+			s.note("%T: %v", v, err)
+			return fmt.Sprintf("%+v", x)
+		}
+		return string(b)
+	case fmt.Stringer:
+		return x.String()
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		ptr := rv.Pointer()
+		if s.seen[ptr] {
+			s.note("%T: cycle detected", v)
+			return cycleValue
+		}
+		s.seen[ptr] = true
+		defer delete(s.seen, ptr)
+		return s.encode(rv.Elem().Interface(), depth)
+	case reflect.Interface:
+		return s.encode(rv.Elem().Interface(), depth)
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		s.encodeStruct(rv, fields, depth)
+		return fields
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		ptr := rv.Pointer()
+		if s.seen[ptr] {
+			s.note("%T: cycle detected", v)
+			return cycleValue
+		}
+		s.seen[ptr] = true
+		defer delete(s.seen, ptr)
+		fields := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			fields[fmt.Sprint(iter.Key().Interface())] = s.encodeValue(iter.Value(), depth+1)
+		}
+		return fields
+	case reflect.Slice:
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return base64.StdEncoding.EncodeToString(rv.Bytes())
+		}
+		ptr := rv.Pointer()
+		if rv.Len() > 0 && s.seen[ptr] {
+			s.note("%T: cycle detected", v)
+			return cycleValue
+		}
+		s.seen[ptr] = true
+		defer delete(s.seen, ptr)
+		return s.encodeList(rv, depth)
+	case reflect.Array:
+		return s.encodeList(rv, depth)
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			s.note("%T: unsupported value %v", v, f)
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	case reflect.Complex64, reflect.Complex128:
+		return fmt.Sprint(v)
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		s.note("%T: unsupported type", v)
+		return fmt.Sprintf("%T", v)
+	}
+	return v
+}
+
+func (s *encodeState) encodeValue(rv reflect.Value, depth int) interface{} {
+	if !rv.IsValid() {
+		return nil
+	}
+	return s.encode(rv.Interface(), depth)
+}
+
+func (s *encodeState) encodeList(rv reflect.Value, depth int) []interface{} {
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = s.encodeValue(rv.Index(i), depth+1)
+	}
+	return list
+}
+
+func (s *encodeState) encodeStruct(rv reflect.Value, fields map[string]interface{}, depth int) {
+	for _, f := range s.encoder.structFields(rv.Type()) {
+		fv := rv.Field(f.index)
+		if f.inline {
+			for fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					break
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				s.encodeStruct(fv, fields, depth)
+				continue
+			}
+		}
+		if !fv.CanInterface() || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if f.redact {
+			fields[f.name] = redactedValue
+			continue
+		}
+		fields[f.name] = s.encodeValue(fv, depth+1)
+	}
+}
+
+func (e *FieldEncoder) structFields(t reflect.Type) []structField {
+	if cached, ok := e.fieldsCache.Load(t); ok {
+		return cached.([]structField)
+	}
+	fields := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("log")
+		if !ok {
+			tag = sf.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := structField{name: opts[0], index: i}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				f.omitEmpty = true
+			case "redact":
+				f.redact = true
+			case "inline":
+				f.inline = true
+			}
+		}
+		if sf.Anonymous && f.name == "" {
+			f.inline = true
+		}
+		if sf.PkgPath != "" && !f.inline {
+			continue
+		}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		fields = append(fields, f)
+	}
+	e.fieldsCache.Store(t, fields)
+	return fields
+}
+
+// isNilPointer reports whether v is a nil pointer or interface, e.g. a typed
+// nil stored in an interface{}.
+func isNilPointer(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+type mapObjectEncoder struct {
+	state  *encodeState
+	depth  int
+	fields map[string]interface{}
+}
+
+func (m *mapObjectEncoder) AddField(key string, value interface{}) {
+	m.fields[key] = m.state.encode(value, m.depth)
+}
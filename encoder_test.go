@@ -0,0 +1,157 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	City    string `log:"city"`
+	Country string `log:"country,omitempty"`
+}
+
+type testUser struct {
+	ID       string       `log:"id"`
+	Password string       `log:"password,redact"`
+	Nick     string       `log:"nick,omitempty"`
+	Address  testAddress  `log:",inline"`
+	Internal string       `log:"-"`
+	Email    string       `json:"email"`
+	Friend   *testUser    `log:"friend,omitempty"`
+	Tags     []string     `log:"tags"`
+	Meta     testMarshals `log:"meta"`
+}
+
+type testMarshals struct{}
+
+func (testMarshals) MarshalLogObject(enc ObjectEncoder) error {
+	enc.AddField("custom", true)
+	return nil
+}
+
+type testSecret string
+
+func (testSecret) LogValue() interface{} {
+	return "secret-id"
+}
+
+func formatEntry(t *testing.T, formatter *EpicFormatter, value interface{}) map[string]interface{} {
+	b, err := formatter.Format(epicLogger.WithField("value", value).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	return entry
+}
+
+func TestStructTags(t *testing.T) {
+	user := testUser{ID: "42", Password: "hunter2", Address: testAddress{City: "Lagos"}, Internal: "x", Email: "a@b.c", Tags: []string{"a"}}
+	entry := formatEntry(t, &EpicFormatter{}, user)
+
+	value := entry["value"].(map[string]interface{})
+	if value["id"] != "42" {
+		t.Fatal("id field not set, was: ", value["id"])
+	}
+	if value["password"] != redactedValue {
+		t.Fatal("password field not redacted, was: ", value["password"])
+	}
+	if _, ok := value["nick"]; ok {
+		t.Fatal("empty nick field not omitted")
+	}
+	if value["city"] != "Lagos" {
+		t.Fatal("inline city field not set, was: ", value["city"])
+	}
+	if _, ok := value["country"]; ok {
+		t.Fatal("empty inline country field not omitted")
+	}
+	if _, ok := value["Internal"]; ok {
+		t.Fatal("ignored field was logged")
+	}
+	if value["email"] != "a@b.c" {
+		t.Fatal("json tag name not used, was: ", value["email"])
+	}
+	if value["meta"].(map[string]interface{})["custom"] != true {
+		t.Fatal("ObjectMarshaler output not used, was: ", value["meta"])
+	}
+}
+
+func TestStructCycle(t *testing.T) {
+	user := &testUser{ID: "1"}
+	user.Friend = user
+	entry := formatEntry(t, &EpicFormatter{}, user)
+
+	value := entry["value"].(map[string]interface{})
+	if value["friend"] != cycleValue {
+		t.Fatal("cycle not detected, was: ", value["friend"])
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}}
+	entry := formatEntry(t, &EpicFormatter{Encoder: &FieldEncoder{MaxDepth: 2}}, nested)
+
+	a := entry["value"].(map[string]interface{})["a"].(map[string]interface{})
+	if a["b"] != maxDepthValue {
+		t.Fatal("max depth not enforced, was: ", a["b"])
+	}
+}
+
+func TestLogValuer(t *testing.T) {
+	entry := formatEntry(t, &EpicFormatter{}, testSecret("password"))
+	if entry["value"] != "secret-id" {
+		t.Fatal("LogValue not used, was: ", entry["value"])
+	}
+}
+
+func TestTextFormatterUsesEncoder(t *testing.T) {
+	formatter := &TextFormatter{DisableColors: true}
+
+	b, err := formatter.Format(epicLogger.WithField("user", testUser{ID: "42", Password: "hunter2"}).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+	if strings.Contains(string(b), "hunter2") {
+		t.Fatal("redacted field was logged: ", string(b))
+	}
+	if !strings.Contains(string(b), `\"id\":\"42\"`) {
+		t.Fatal("id field not logged: ", string(b))
+	}
+}
+
+type testNilError struct{}
+
+func (*testNilError) Error() string {
+	return "never called"
+}
+
+type testTimes struct {
+	At  *time.Time `log:"at"`
+	URL *url.URL   `log:"url"`
+}
+
+func TestTypedNil(t *testing.T) {
+	var at *time.Time
+	var u *url.URL
+	var err *testNilError
+	var secret *testSecret
+	for _, value := range []interface{}{at, u, err, secret} {
+		entry := formatEntry(t, &EpicFormatter{}, value)
+		if v, ok := entry["value"]; !ok || v != nil {
+			t.Fatalf("typed nil %T not logged as null, was: %v", value, v)
+		}
+	}
+
+	entry := formatEntry(t, &EpicFormatter{}, testTimes{})
+	value := entry["value"].(map[string]interface{})
+	if value["at"] != nil || value["url"] != nil {
+		t.Fatal("nested typed nils not logged as null, was: ", value)
+	}
+}
@@ -0,0 +1,212 @@
+package epiclogger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	errorReporting "google.golang.org/api/clouderrorreporting/v1beta1"
+)
+
+// DefaultErrorReportingEndpoint is the Error Reporting API base URL.
+const DefaultErrorReportingEndpoint = "https://clouderrorreporting.googleapis.com"
+
+// DefaultErrorReportingRate is the default number of events reported per second.
+const DefaultErrorReportingRate = 10
+
+// ErrorReportingConfig configures an ErrorReportingHook.
+type ErrorReportingConfig struct {
+	// ProjectID is the Google Cloud project the errors are reported to.
+	ProjectID string
+
+	// APIKey is sent as the key query parameter when set, as an alternative
+	// to a Client adding OAuth credentials.
+	APIKey string
+
+	// Service and Version are reported when the entry has no service or
+	// version field.
+	Service string
+	Version string
+
+	// Endpoint is the API base URL, DefaultErrorReportingEndpoint when empty.
+	Endpoint string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter decides which fields are lifted into the reported event.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels reported, error and above when nil.
+	LogLevels []log.Level
+
+	// Rate is the maximum number of events reported per second,
+	// DefaultErrorReportingRate when zero, unlimited when negative.
+	// Burst events, one second worth of events when zero, can be sent at
+	// once after a quiet period. Flush and
+	// Close don't wait for the rate limit: the events over it stay queued
+	// on Flush and are dropped on Close.
+	Rate  float64
+	Burst int
+
+	// BatchCount and FlushInterval bound how long events wait in the queue.
+	BatchCount    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of events kept in memory while waiting to be
+	// reported, new events are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed reports, not
+	// waited for during Flush and Close. An event still failing after the
+	// retries is queued again with the rest of its batch, up to QueueSize,
+	// and sent with the next batch.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// ErrorReportingHook reports error entries straight to the Error Reporting
+// events:report API, for hosts where no agent forwards the logs.
+type ErrorReportingHook struct {
+	config  ErrorReportingConfig
+	url     string
+	limiter *rateLimiter
+	retry   *retryPolicy
+	batchSink
+
+	// draining is positive during Flush and Close
+	draining int32
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// NewErrorReportingHook returns a hook reporting error entries in the
+// background. Close it before exiting to report the last errors.
+func NewErrorReportingHook(config ErrorReportingConfig) (*ErrorReportingHook, error) {
+	if config.ProjectID == "" {
+		return nil, fmt.Errorf("epiclogger: a ProjectID is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultErrorReportingEndpoint
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+	}
+	if config.Rate == 0 {
+		config.Rate = DefaultErrorReportingRate
+	}
+	if config.Burst == 0 {
+		config.Burst = int(math.Ceil(config.Rate))
+	}
+
+	reportURL := strings.TrimSuffix(config.Endpoint, "/") + "/v1beta1/projects/" + url.PathEscape(config.ProjectID) + "/events:report"
+	if config.APIKey != "" {
+		reportURL += "?key=" + url.QueryEscape(config.APIKey)
+	}
+	h := &ErrorReportingHook{
+		config:  config,
+		url:     reportURL,
+		limiter: newRateLimiter(config.Rate, config.Burst),
+		retry:   newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.start("error reporting", newBatchOptions(config.BatchCount, 0, config.FlushInterval, config.QueueSize), h.report)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *ErrorReportingHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook. The event is queued, not sent.
+func (h *ErrorReportingHook) Fire(entry *log.Entry) error {
+	event, err := h.event(entry)
+	if err != nil {
+		return err
+	}
+	return h.queue(entry, event, len(event.Message))
+}
+
+// Flush reports the queued events within the rate limit and waits for them
+// to be sent.
+func (h *ErrorReportingHook) Flush() error {
+	atomic.AddInt32(&h.draining, 1)
+	defer atomic.AddInt32(&h.draining, -1)
+	return h.batchSink.Flush()
+}
+
+// Close reports the queued events within the rate limit and stops the hook.
+func (h *ErrorReportingHook) Close() error {
+	atomic.AddInt32(&h.draining, 1)
+	return h.batchSink.Close()
+}
+
+// report sends the events one by one, events:report has no batch call.
+// Events rejected by the API are dropped, events over the rate limit while
+// draining are queued again. Once an event still fails after the retries,
+// the API is considered down: it and the rest of the batch are queued again
+// without calling it.
+func (h *ErrorReportingHook) report(items []interface{}) error {
+	draining := atomic.LoadInt32(&h.draining) > 0
+	var failed int
+	var retry []interface{}
+	var lastErr error
+	for i, item := range items {
+		if !h.limiter.take(!draining) {
+			retry = append(retry, item)
+			lastErr = errRateLimited
+			continue
+		}
+		event := item.(*errorReporting.ReportedErrorEvent)
+		send := func() error {
+			_, err := postJSON(h.config.Client, h.url, event, nil)
+			return err
+		}
+		var err error
+		if draining {
+			// the process may be exiting, don't sleep between retries
+			err = send()
+		} else {
+			err = h.retry.do(send)
+		}
+		if err == nil {
+			continue
+		}
+		lastErr = err
+		if isRetryable(err) {
+			retry = append(retry, items[i:]...)
+			break
+		}
+		failed++
+	}
+	if failed > 0 || len(retry) > 0 {
+		return &partialError{dropped: failed, total: len(items), err: lastErr, retry: retry}
+	}
+	return nil
+}
+
+func (h *ErrorReportingHook) event(entry *log.Entry) (*errorReporting.ReportedErrorEvent, error) {
+	f := h.config.Formatter
+	data, httpReq, err := f.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+	event := buildErrorReportingEvent(entry, data, httpReq, f.errorReportingFields())
+	event.EventTime = entry.Time.Format(time.RFC3339Nano)
+	if event.ServiceContext.Service == "" {
+		event.ServiceContext.Service = h.config.Service
+	}
+	if event.ServiceContext.Version == "" {
+		event.ServiceContext.Version = h.config.Version
+	}
+	return &event, nil
+}
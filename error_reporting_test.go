@@ -0,0 +1,181 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	errorReporting "google.golang.org/api/clouderrorreporting/v1beta1"
+)
+
+func TestErrorReportingHook(t *testing.T) {
+	var mu sync.Mutex
+	var events []errorReporting.ReportedErrorEvent
+	var paths []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event errorReporting.ReportedErrorEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		events = append(events, event)
+		paths = append(paths, r.URL.RequestURI())
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	hook, err := NewErrorReportingHook(ErrorReportingConfig{
+		ProjectID:     "my-project",
+		APIKey:        "secret",
+		Service:       "fallback-service",
+		Endpoint:      server.URL,
+		RetryBackoff:  time.Millisecond,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	logger.Info("not reported")
+	logger.WithError(errors.New("boom")).Error("something failed")
+	entry := logger.WithField("version", "42").Entry
+	entry.Level = logrus.ErrorLevel
+	entry.Message = "no service"
+	assert.NoError(t, hook.Fire(entry))
+	// retried in the background, not while closing
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		sent := len(events)
+		mu.Unlock()
+		if sent == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, hook.Close())
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "/v1beta1/projects/my-project/events:report?key=secret", paths[0])
+	assert.Equal(t, "something failed", events[0].Message)
+	assert.Equal(t, "golang-service", events[0].ServiceContext.Service)
+	assert.Equal(t, "123", events[0].ServiceContext.Version)
+	assert.Equal(t, "fallback-service", events[1].ServiceContext.Service)
+	assert.Equal(t, "42", events[1].ServiceContext.Version)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait()
+	}
+	// the first event uses the burst, the two others wait 10ms each
+	assert.True(t, time.Since(start) >= 15*time.Millisecond)
+}
+
+func TestErrorReportingHookRequeuesFailedEvents(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event errorReporting.ReportedErrorEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		messages = append(messages, event.Message)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	hook, err := NewErrorReportingHook(ErrorReportingConfig{
+		ProjectID:    "my-project",
+		Endpoint:     server.URL,
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	logger.Error("first")
+	assert.Error(t, hook.Flush())
+	assert.Equal(t, 0, len(messages))
+
+	logger.Error("second")
+	assert.NoError(t, hook.Flush())
+	assert.Equal(t, []string{"first", "second"}, messages)
+	assert.NoError(t, hook.Close())
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&hook.batcher.dropped))
+}
+
+func TestErrorReportingHookCloseDoesNotWaitForRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	hook, err := NewErrorReportingHook(ErrorReportingConfig{
+		ProjectID: "my-project",
+		Endpoint:  server.URL,
+		Rate:      1,
+		Burst:     2,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	for i := 0; i < 10; i++ {
+		logger.Error("failed")
+	}
+	start := time.Now()
+	assert.NoError(t, hook.Close())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, uint64(8), atomic.LoadUint64(&hook.batcher.dropped))
+}
+
+func TestErrorReportingHookStopsAtFirstFailure(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	hook, err := NewErrorReportingHook(ErrorReportingConfig{
+		ProjectID:    "my-project",
+		Endpoint:     server.URL,
+		RetryBackoff: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	for i := 0; i < 5; i++ {
+		logger.Error("failed")
+	}
+	// neither waits for the backoff nor calls the API for each event
+	assert.Error(t, hook.Flush())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.NoError(t, hook.Close())
+	assert.Equal(t, uint64(5), atomic.LoadUint64(&hook.batcher.dropped))
+}
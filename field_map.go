@@ -0,0 +1,86 @@
+package epiclogger
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type fieldKey string
+
+// FieldMap allows customization of the key names for the fields the
+// formatters write themselves.
+// As an example:
+//
+//	formatter := &EpicFormatter{
+//		FieldMap: FieldMap{
+//			FieldKeyTime:     "@timestamp",
+//			FieldKeySeverity: "@level",
+//			FieldKeyMessage:  "@message",
+//		},
+//	}
+type FieldMap map[fieldKey]string
+
+// Default key names for the fields written by the formatters.
+const (
+	FieldKeyTime          fieldKey = "time"
+	FieldKeyMessage       fieldKey = "message"
+	FieldKeySeverity      fieldKey = "severity"
+	FieldKeyHTTPRequest   fieldKey = "httpRequest"
+	FieldKeyUserID        fieldKey = "userId"
+	FieldKeyCorrelationID fieldKey = "correlationId"
+)
+
+func (f FieldMap) resolve(key fieldKey) string {
+	return f.resolveOr(key, string(key))
+}
+
+func (f FieldMap) resolveOr(key fieldKey, fallback string) string {
+	if k, ok := f[key]; ok {
+		return k
+	}
+	return fallback
+}
+
+// ClashPolicy decides what happens to a user field that has the same key as
+// a field written by the formatter.
+type ClashPolicy int
+
+const (
+	// ClashPrefix keeps the user field under ClashPrefix + key.
+	ClashPrefix ClashPolicy = iota
+	// ClashDrop silently drops the user field.
+	ClashDrop
+	// ClashError fails the formatting of the entry.
+	ClashError
+)
+
+// DefaultClashPrefix is prepended to clashing keys with the ClashPrefix policy.
+const DefaultClashPrefix = "fields."
+
+// defaultErrorReportingFields are the fields lifted into the Error Reporting
+// serviceContext and context on error entries.
+var defaultErrorReportingFields = []string{"service", "version", "caller", "user", "stack"}
+
+// resolveFieldClashes applies policy to every user field in data whose key is
+// one of reserved.
+func resolveFieldClashes(data log.Fields, reserved []string, policy ClashPolicy, prefix string) error {
+	if prefix == "" {
+		prefix = DefaultClashPrefix
+	}
+	for _, k := range reserved {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+		switch policy {
+		case ClashDrop:
+		case ClashError:
+			return fmt.Errorf("field %q clashes with a reserved key", k)
+		default:
+			data[prefix+k] = v
+		}
+		delete(data, k)
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package epiclogger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the Fluentd forward sink.
+const (
+	DefaultFluentAddress    = "127.0.0.1:24224"
+	DefaultFluentTag        = "epiclogger"
+	DefaultFluentSpoolBytes = 100 * 1024 * 1024
+	DefaultFluentReplays    = 5
+)
+
+const spoolSuffix = ".chunk"
+
+// FluentConfig configures a FluentHook.
+type FluentConfig struct {
+	// Network is "tcp" or "unix", "tcp" when empty.
+	Network string
+
+	// Address of the Fluentd or Fluent Bit forward input,
+	// DefaultFluentAddress when empty.
+	Address string
+
+	// Tag routes the entries in Fluentd, DefaultFluentTag when empty.
+	Tag string
+
+	// RequireAck asks the collector to acknowledge every chunk, chunks
+	// not acknowledged within AckTimeout (10s when zero) are sent again.
+	RequireAck bool
+	AckTimeout time.Duration
+
+	// DialTimeout and WriteTimeout bound the network calls, 5s when zero.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Formatter builds the record of each entry with FormatMap.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels sent, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound the chunks.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// sent, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control the reconnections before a chunk
+	// is spooled or dropped.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// SpoolDir keeps the chunks that couldn't be sent, while the collector
+	// restarts for instance. They are sent again, oldest first, before any
+	// new chunk. Chunks are dropped when SpoolDir is empty.
+	SpoolDir string
+
+	// SpoolMaxBytes bounds the size of SpoolDir,
+	// DefaultFluentSpoolBytes when zero.
+	SpoolMaxBytes int64
+
+	// SpoolMaxReplays is the number of times a spooled chunk is sent again
+	// without being acknowledged before it is dropped, DefaultFluentReplays
+	// when zero. Failing to connect to the collector isn't counted. Corrupt
+	// chunks, written partially before a crash for instance, are dropped
+	// right away.
+	SpoolMaxReplays int
+}
+
+// FluentHook sends entries to Fluentd or Fluent Bit with the Forward
+// protocol, in PackedForward mode.
+type FluentHook struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	spoolBytes int64
+
+	config FluentConfig
+	retry  *retryPolicy
+	batchSink
+
+	conn net.Conn
+	// failed replays by spooled chunk
+	replays map[string]int
+}
+
+// NewFluentHook returns a hook sending entries in the background. Close it
+// before exiting to send the last entries.
+func NewFluentHook(config FluentConfig) (*FluentHook, error) {
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Address == "" {
+		config.Address = DefaultFluentAddress
+	}
+	if config.Tag == "" {
+		config.Tag = DefaultFluentTag
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	if config.SpoolMaxBytes == 0 {
+		config.SpoolMaxBytes = DefaultFluentSpoolBytes
+	}
+	config.SpoolMaxReplays = limit(config.SpoolMaxReplays, DefaultFluentReplays)
+	config.AckTimeout = durationOr(config.AckTimeout, 10*time.Second)
+	config.DialTimeout = durationOr(config.DialTimeout, 5*time.Second)
+	config.WriteTimeout = durationOr(config.WriteTimeout, 5*time.Second)
+
+	h := &FluentHook{
+		config:  config,
+		retry:   newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+		replays: map[string]int{},
+	}
+	if config.SpoolDir != "" {
+		if err := os.MkdirAll(config.SpoolDir, 0700); err != nil {
+			return nil, fmt.Errorf("epiclogger: can't create the spool: %v", err)
+		}
+		// chunks being written when a previous run stopped
+		if tmps, err := filepath.Glob(filepath.Join(config.SpoolDir, "*"+spoolSuffix+".tmp")); err == nil {
+			for _, tmp := range tmps {
+				os.Remove(tmp)
+			}
+		}
+		// chunks left by a previous run are sent too
+		for _, name := range h.spooled() {
+			if info, err := os.Stat(filepath.Join(config.SpoolDir, name)); err == nil {
+				h.spoolBytes += info.Size()
+			}
+		}
+	}
+	h.start("fluent", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.send)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *FluentHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *FluentHook) Fire(entry *log.Entry) error {
+	record, err := h.config.Formatter.FormatMap(entry)
+	if err != nil {
+		return err
+	}
+	e := &msgpackEncoder{}
+	e.encodeArrayHeader(2)
+	e.encodeEventTime(entry.Time)
+	e.encode(record)
+	return h.queue(entry, e.buf, len(e.buf))
+}
+
+// Close sends the queued entries and closes the connection.
+func (h *FluentHook) Close() error {
+	h.batchSink.Close()
+	if h.conn != nil {
+		return h.conn.Close()
+	}
+	return nil
+}
+
+func newChunkID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// message encodes the PackedForward message [tag, entries, option].
+func (h *FluentHook) message(entries []byte, count int, chunk string) []byte {
+	option := map[string]interface{}{"size": count}
+	if h.config.RequireAck {
+		option["chunk"] = chunk
+	}
+	e := &msgpackEncoder{}
+	e.encodeArrayHeader(3)
+	e.encodeString(h.config.Tag)
+	e.encodeBinary(entries)
+	e.encode(option)
+	return e.buf
+}
+
+func (h *FluentHook) send(items []interface{}) error {
+	var entries []byte
+	for _, item := range items {
+		entries = append(entries, item.([]byte)...)
+	}
+	chunk := newChunkID()
+	msg := h.message(entries, len(items), chunk)
+
+	// keep the order: new chunks wait behind the spooled ones
+	if h.config.SpoolDir != "" && !h.replay() {
+		return h.spool(chunk, msg, len(items))
+	}
+	err := h.retry.do(func() error {
+		return h.write(msg, chunk)
+	})
+	if err != nil && h.config.SpoolDir != "" {
+		return h.spool(chunk, msg, len(items))
+	}
+	return err
+}
+
+// write sends msg on the current connection, dialing a new one when there
+// is none, and waits for its ack when required.
+func (h *FluentHook) write(msg []byte, chunk string) error {
+	if err := h.connect(); err != nil {
+		return &connError{err}
+	}
+	err := h.writeAndAck(msg, chunk)
+	if err != nil {
+		h.conn.Close()
+		h.conn = nil
+		return &connError{err}
+	}
+	return nil
+}
+
+func (h *FluentHook) connect() error {
+	if h.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout(h.config.Network, h.config.Address, h.config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+func (h *FluentHook) writeAndAck(msg []byte, chunk string) error {
+	h.conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+	if _, err := h.conn.Write(msg); err != nil {
+		return err
+	}
+	if !h.config.RequireAck {
+		return nil
+	}
+	h.conn.SetReadDeadline(time.Now().Add(h.config.AckTimeout))
+	resp, err := (&msgpackDecoder{r: h.conn}).decode()
+	if err != nil {
+		return fmt.Errorf("no ack for chunk %s: %v", chunk, err)
+	}
+	if m, ok := resp.(map[string]interface{}); !ok || m["ack"] != chunk {
+		return fmt.Errorf("unexpected ack %v for chunk %s", resp, chunk)
+	}
+	return nil
+}
+
+// spooled returns the names of the spooled chunks, oldest first.
+func (h *FluentHook) spooled() []string {
+	files, err := ioutil.ReadDir(h.config.SpoolDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), spoolSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// spool saves a chunk that couldn't be sent. It is written aside and
+// renamed, so that a crash never leaves half a chunk in the spool.
+func (h *FluentHook) spool(chunk string, msg []byte, count int) error {
+	if atomic.LoadInt64(&h.spoolBytes)+int64(len(msg)) > h.config.SpoolMaxBytes {
+		return &partialError{dropped: count, total: count, err: fmt.Errorf("spool full")}
+	}
+	path := filepath.Join(h.config.SpoolDir, fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), chunk, spoolSuffix))
+	if err := ioutil.WriteFile(path+".tmp", msg, 0600); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	atomic.AddInt64(&h.spoolBytes, int64(len(msg)))
+	return nil
+}
+
+// replay sends the spooled chunks, oldest first, and reports whether the
+// spool is empty. A single attempt is made, the collector is likely down
+// when it fails. Corrupt chunks and chunks sent SpoolMaxReplays times
+// without an ack are dropped, so that they don't hold back the others.
+func (h *FluentHook) replay() bool {
+	for _, name := range h.spooled() {
+		path := filepath.Join(h.config.SpoolDir, name)
+		msg, err := ioutil.ReadFile(path)
+		if err != nil {
+			reportError("dropped spooled chunk %s: %v", name, err)
+			h.unspool(name, 0)
+			continue
+		}
+		if !validChunk(msg) {
+			reportError("dropped corrupt spooled chunk %s", name)
+			h.unspool(name, int64(len(msg)))
+			continue
+		}
+		if err := h.connect(); err != nil {
+			return false
+		}
+		chunk := strings.TrimSuffix(name[strings.IndexByte(name, '-')+1:], spoolSuffix)
+		if err := h.write(msg, chunk); err != nil {
+			if h.replays[name]++; h.replays[name] < h.config.SpoolMaxReplays {
+				return false
+			}
+			reportError("dropped spooled chunk %s after %d replays: %v", name, h.replays[name], err)
+		}
+		h.unspool(name, int64(len(msg)))
+	}
+	return true
+}
+
+// unspool removes a spooled chunk of size bytes.
+func (h *FluentHook) unspool(name string, size int64) {
+	os.Remove(filepath.Join(h.config.SpoolDir, name))
+	delete(h.replays, name)
+	atomic.AddInt64(&h.spoolBytes, -size)
+}
+
+// validChunk reports whether msg is a complete PackedForward message.
+func validChunk(msg []byte) bool {
+	r := bytes.NewReader(msg)
+	v, err := (&msgpackDecoder{r: r}).decode()
+	message, ok := v.([]interface{})
+	return err == nil && ok && len(message) == 3 && r.Len() == 0
+}
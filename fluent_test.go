@@ -0,0 +1,170 @@
+package epiclogger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeForward decodes a PackedForward message.
+func decodeForward(t *testing.T, msg interface{}) (string, [][]interface{}, map[string]interface{}) {
+	parts := msg.([]interface{})
+	assert.Equal(t, 3, len(parts))
+	option, _ := parts[2].(map[string]interface{})
+	var entries [][]interface{}
+	d := &msgpackDecoder{r: bytes.NewReader(parts[1].([]byte))}
+	for {
+		entry, err := d.decode()
+		if err != nil {
+			break
+		}
+		entries = append(entries, entry.([]interface{}))
+	}
+	return parts[0].(string), entries, option
+}
+
+// fakeFluent acknowledges the messages it receives on l and passes them on.
+func fakeFluent(l net.Listener, messages chan<- interface{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			d := &msgpackDecoder{r: conn}
+			for {
+				msg, err := d.decode()
+				if err != nil {
+					return
+				}
+				if option, ok := msg.([]interface{})[2].(map[string]interface{}); ok && option["chunk"] != nil {
+					e := &msgpackEncoder{}
+					e.encode(map[string]interface{}{"ack": option["chunk"]})
+					conn.Write(e.buf)
+				}
+				messages <- msg
+			}
+		}()
+	}
+}
+
+func TestFluentHook(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	messages := make(chan interface{}, 10)
+	go fakeFluent(l, messages)
+
+	hook, err := NewFluentHook(FluentConfig{Address: l.Addr().String(), Tag: "app.logs", RequireAck: true})
+	assert.NoError(t, err)
+
+	entry := logrus.WithFields(logrus.Fields{"user": "jane", "attempt": 3})
+	entry.Level = logrus.InfoLevel
+	entry.Time = time.Unix(1500000000, 42)
+	entry.Message = "signed in"
+	assert.NoError(t, hook.Fire(entry))
+	assert.NoError(t, hook.Close())
+
+	tag, entries, option := decodeForward(t, <-messages)
+	assert.Equal(t, "app.logs", tag)
+	assert.Equal(t, int64(1), option["size"])
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, time.Unix(1500000000, 42), entries[0][0])
+	record := entries[0][1].(map[string]interface{})
+	assert.Equal(t, "signed in", record["message"])
+	assert.Equal(t, "INFO", record["severity"])
+	assert.Equal(t, "jane", record["user"])
+	assert.Equal(t, int64(3), record["attempt"])
+}
+
+func TestFluentHookSpool(t *testing.T) {
+	// reserve an address, the collector only starts after the first chunk
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+	spool, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spool)
+
+	hook, err := NewFluentHook(FluentConfig{Address: address, SpoolDir: spool, MaxRetries: -1})
+	assert.NoError(t, err)
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	entry.Level = logrus.InfoLevel
+	entry.Message = "first"
+	assert.NoError(t, hook.Fire(entry))
+	assert.NoError(t, hook.Flush())
+	files, _ := ioutil.ReadDir(spool)
+	assert.Equal(t, 1, len(files))
+
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("address reused meanwhile:", err)
+	}
+	defer l.Close()
+	messages := make(chan interface{}, 10)
+	go fakeFluent(l, messages)
+
+	entry.Message = "second"
+	assert.NoError(t, hook.Fire(entry))
+	assert.NoError(t, hook.Close())
+	for _, expected := range []string{"first", "second"} {
+		_, entries, _ := decodeForward(t, <-messages)
+		assert.Equal(t, expected, entries[0][1].(map[string]interface{})["message"])
+	}
+	files, _ = ioutil.ReadDir(spool)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestFluentHookSpoolBadChunks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	messages := make(chan interface{}, 10)
+	go fakeFluent(l, messages)
+	spool, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spool)
+
+	config := FluentConfig{Address: l.Addr().String(), RequireAck: true, SpoolDir: spool, SpoolMaxReplays: 2, MaxRetries: -1}
+	hook, err := NewFluentHook(config)
+	assert.NoError(t, err)
+	// cut by a crash, and acked with another chunk id
+	msg := hook.message(nil, 0, "other")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(spool, "00000000000000000001-cut"+spoolSuffix), msg[:len(msg)-3], 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(spool, "00000000000000000002-unacked"+spoolSuffix), msg, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(spool, "00000000000000000003-tmp"+spoolSuffix+".tmp"), msg, 0600))
+	hook.Close()
+
+	hook, err = NewFluentHook(config)
+	assert.NoError(t, err)
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	entry.Level = logrus.InfoLevel
+	for _, message := range []string{"first", "second"} {
+		entry.Message = message
+		assert.NoError(t, hook.Fire(entry))
+		assert.NoError(t, hook.Flush())
+	}
+	assert.NoError(t, hook.Close())
+
+	var received []string
+	for len(messages) > 0 {
+		_, entries, _ := decodeForward(t, <-messages)
+		for _, entry := range entries {
+			received = append(received, entry[1].(map[string]interface{})["message"].(string))
+		}
+	}
+	assert.Equal(t, []string{"first", "second"}, received)
+	files, _ := ioutil.ReadDir(spool)
+	assert.Equal(t, 0, len(files))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&hook.spoolBytes))
+}
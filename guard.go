@@ -0,0 +1,335 @@
+package epiclogger
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the hook guard.
+const (
+	DefaultFailureThreshold = 5
+	DefaultFailureWindow    = time.Minute
+	DefaultBreakerCooldown  = 30 * time.Second
+	DefaultHealthInterval   = time.Minute
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// GuardConfig configures a GuardedHook.
+type GuardConfig struct {
+	// Name identifies the hook in warnings and stats.
+	Name string
+
+	// Async fires the hook on a background goroutine, the entries waiting
+	// in a queue of QueueSize entries (DefaultQueueSize when zero). Entries
+	// are dropped once it is full.
+	Async     bool
+	QueueSize int
+
+	// Timeout bounds each call of the hook. A call taking longer is
+	// abandoned and counted as a failure. No limit when zero.
+	Timeout time.Duration
+
+	// The circuit breaker opens after FailureThreshold failures within
+	// FailureWindow, DefaultFailureThreshold and DefaultFailureWindow when
+	// zero. The hook isn't called while it is open. After Cooldown
+	// (DefaultBreakerCooldown when zero), one entry probes the hook: the
+	// breaker closes if it succeeds and opens again if it fails.
+	FailureThreshold int
+	FailureWindow    time.Duration
+	Cooldown         time.Duration
+
+	// HealthInterval is the interval of the warnings written to stderr
+	// while the hook fails or drops entries, DefaultHealthInterval when
+	// zero. Negative disables them.
+	HealthInterval time.Duration
+}
+
+// HookStats are the counters of a GuardedHook.
+type HookStats struct {
+	Name string
+
+	// Fired, Failed and TimedOut count the calls of the hook, TimedOut
+	// calls being counted as Failed too.
+	Fired    uint64
+	Failed   uint64
+	TimedOut uint64
+
+	// Rejected counts the entries skipped while the breaker was open,
+	// Dropped the entries dropped because the queue was full.
+	Rejected uint64
+	Dropped  uint64
+
+	// Breaker is BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	Breaker string
+
+	// QueueDepth is the number of entries waiting in async mode.
+	QueueDepth int
+}
+
+// GuardedHook protects the logger from a hook that fails or hangs, with
+// timeouts, an async mode and a circuit breaker.
+type GuardedHook struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	fired    uint64
+	failed   uint64
+	timedOut uint64
+	rejected uint64
+	dropped  uint64
+
+	hook    log.Hook
+	config  GuardConfig
+	breaker *breaker
+	batcher *batcher
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewGuardedHook returns hook wrapped with a guard. Close it to stop the
+// background goroutines.
+func NewGuardedHook(hook log.Hook, config GuardConfig) *GuardedHook {
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("%T", hook)
+	}
+	h := &GuardedHook{
+		hook:   hook,
+		config: config,
+		breaker: &breaker{
+			state:     BreakerClosed,
+			threshold: limit(config.FailureThreshold, DefaultFailureThreshold),
+			window:    durationOr(config.FailureWindow, DefaultFailureWindow),
+			cooldown:  durationOr(config.Cooldown, DefaultBreakerCooldown),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if config.Async {
+		h.batcher = newBatcher(newBatchOptions(1, 0, 0, config.QueueSize), h.send)
+	}
+	go h.reportHealth(durationOr(config.HealthInterval, DefaultHealthInterval))
+	return h
+}
+
+// Levels implements logrus.Hook.
+func (h *GuardedHook) Levels() []log.Level {
+	return h.hook.Levels()
+}
+
+// Fire implements logrus.Hook. Entries skipped while the breaker is open or
+// dropped because the queue is full aren't reported as errors, they are
+// counted and reported in the periodic warnings.
+func (h *GuardedHook) Fire(entry *log.Entry) error {
+	if !h.config.Async {
+		return h.call(entry)
+	}
+	if !h.batcher.add(copyEntry(entry), 1) {
+		atomic.AddUint64(&h.dropped, 1)
+		return nil
+	}
+	// logrus exits or panics right after firing the hooks
+	if entry.Level <= log.FatalLevel {
+		return h.Flush()
+	}
+	return nil
+}
+
+func (h *GuardedHook) send(items []interface{}) error {
+	for _, item := range items {
+		// failures are counted and reported by the health warnings
+		h.call(item.(*log.Entry))
+	}
+	return nil
+}
+
+// call fires the hook through the breaker and within the timeout.
+func (h *GuardedHook) call(entry *log.Entry) error {
+	if !h.breaker.allow() {
+		atomic.AddUint64(&h.rejected, 1)
+		return nil
+	}
+	err := h.fire(entry)
+	h.breaker.record(err == nil)
+	if err != nil {
+		atomic.AddUint64(&h.failed, 1)
+		return err
+	}
+	atomic.AddUint64(&h.fired, 1)
+	return nil
+}
+
+func (h *GuardedHook) fire(entry *log.Entry) error {
+	if h.config.Timeout <= 0 {
+		return h.hook.Fire(entry)
+	}
+	// the entry may outlive the call when the hook hangs
+	entry = copyEntry(entry)
+	result := make(chan error, 1)
+	go func() {
+		result <- h.hook.Fire(entry)
+	}()
+	timer := time.NewTimer(h.config.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		atomic.AddUint64(&h.timedOut, 1)
+		return fmt.Errorf("epiclogger: %s timed out after %v", h.config.Name, h.config.Timeout)
+	}
+}
+
+// Stats returns the counters of the hook.
+func (h *GuardedHook) Stats() HookStats {
+	stats := HookStats{
+		Name:     h.config.Name,
+		Fired:    atomic.LoadUint64(&h.fired),
+		Failed:   atomic.LoadUint64(&h.failed),
+		TimedOut: atomic.LoadUint64(&h.timedOut),
+		Rejected: atomic.LoadUint64(&h.rejected),
+		Dropped:  atomic.LoadUint64(&h.dropped),
+		Breaker:  h.breaker.current(),
+	}
+	if h.batcher != nil {
+		stats.QueueDepth = h.batcher.depth()
+	}
+	return stats
+}
+
+// reportHealth warns on stderr every interval while the hook fails or
+// drops entries.
+func (h *GuardedHook) reportHealth(interval time.Duration) {
+	defer close(h.done)
+	if interval < 0 {
+		<-h.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last HookStats
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		stats := h.Stats()
+		failed, rejected, dropped := stats.Failed-last.Failed, stats.Rejected-last.Rejected, stats.Dropped-last.Dropped
+		if stats.Breaker != BreakerClosed || failed > 0 || dropped > 0 {
+			reportError("hook %s unhealthy: breaker %s, %d failed, %d skipped, %d dropped in the last %v",
+				stats.Name, stats.Breaker, failed, rejected, dropped, interval)
+		}
+		last = stats
+	}
+}
+
+// Flush waits for the queued entries in async mode, and flushes the hook
+// when it supports it.
+func (h *GuardedHook) Flush() error {
+	var err error
+	if h.batcher != nil {
+		err = h.batcher.flush()
+	}
+	if flusher, ok := h.hook.(interface {
+		Flush() error
+	}); ok {
+		if flushErr := flusher.Flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Close fires the queued entries, stops the guard and closes the hook when
+// it supports it.
+func (h *GuardedHook) Close() error {
+	if h.batcher != nil {
+		h.batcher.close()
+	}
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+	if closer, ok := h.hook.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// breaker is a circuit breaker counting the failures in a sliding window.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures []time.Time
+	openedAt time.Time
+}
+
+// allow reports whether a call may go through. Once the cooldown is over,
+// a single call goes through to probe the hook.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record updates the breaker with the result of an allowed call.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if success {
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+			b.failures = nil
+		}
+		return
+	}
+	if b.state == BreakerHalfOpen {
+		b.state, b.openedAt = BreakerOpen, now
+		return
+	}
+	recent := b.failures[:0]
+	for _, t := range b.failures {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	b.failures = append(recent, now)
+	if len(b.failures) >= b.threshold {
+		b.state, b.openedAt = BreakerOpen, now
+		b.failures = nil
+	}
+}
+
+func (b *breaker) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,116 @@
+package epiclogger
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyHook fails while err is set, and blocks while block is set.
+type faultyHook struct {
+	mu    sync.Mutex
+	err   error
+	block chan struct{}
+	calls int
+}
+
+func (h *faultyHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *faultyHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	h.calls++
+	err, block := h.err, h.block
+	h.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return err
+}
+
+func (h *faultyHook) set(err error, block chan struct{}) {
+	h.mu.Lock()
+	h.err, h.block = err, block
+	h.mu.Unlock()
+}
+
+func (h *faultyHook) called() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func guardedEntry() *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.InfoLevel
+	entry.Message = "hello"
+	return entry
+}
+
+func TestGuardedHookBreaker(t *testing.T) {
+	hook := &faultyHook{err: errors.New("unreachable")}
+	h := NewGuardedHook(hook, GuardConfig{Name: "remote", FailureThreshold: 3, Cooldown: 50 * time.Millisecond, HealthInterval: -1})
+	defer h.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.EqualError(t, h.Fire(guardedEntry()), "unreachable")
+	}
+	assert.Equal(t, BreakerOpen, h.Stats().Breaker)
+	assert.NoError(t, h.Fire(guardedEntry()))
+	assert.Equal(t, 3, hook.called())
+
+	// the probe fails, the breaker opens again
+	time.Sleep(60 * time.Millisecond)
+	assert.Error(t, h.Fire(guardedEntry()))
+	assert.Equal(t, BreakerOpen, h.Stats().Breaker)
+	assert.NoError(t, h.Fire(guardedEntry()))
+	assert.Equal(t, 4, hook.called())
+
+	// the probe succeeds, the breaker closes
+	hook.set(nil, nil)
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, h.Fire(guardedEntry()))
+	assert.NoError(t, h.Fire(guardedEntry()))
+	assert.Equal(t, 6, hook.called())
+
+	stats := h.Stats()
+	assert.Equal(t, HookStats{Name: "remote", Fired: 2, Failed: 4, Rejected: 2, Breaker: BreakerClosed}, stats)
+}
+
+func TestGuardedHookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hook := &faultyHook{block: release}
+	h := NewGuardedHook(hook, GuardConfig{Name: "slow", Timeout: 20 * time.Millisecond, HealthInterval: -1})
+	defer h.Close()
+
+	start := time.Now()
+	assert.EqualError(t, h.Fire(guardedEntry()), "epiclogger: slow timed out after 20ms")
+	assert.True(t, time.Since(start) < time.Second)
+	stats := h.Stats()
+	assert.Equal(t, uint64(1), stats.TimedOut)
+	assert.Equal(t, uint64(1), stats.Failed)
+}
+
+func TestGuardedHookAsync(t *testing.T) {
+	release := make(chan struct{})
+	hook := &faultyHook{block: release}
+	h := NewGuardedHook(hook, GuardConfig{Name: "async", Async: true, QueueSize: 1, HealthInterval: -1})
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, h.Fire(guardedEntry()))
+	}
+
+	hook.set(nil, nil)
+	close(release)
+	assert.NoError(t, h.Flush())
+	stats := h.Stats()
+	assert.True(t, stats.Dropped > 0)
+	assert.Equal(t, 5-stats.Dropped, stats.Fired)
+	assert.NoError(t, h.Close())
+}
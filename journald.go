@@ -0,0 +1,208 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultJournaldSocket is the socket of journald's native protocol.
+const DefaultJournaldSocket = "/run/systemd/journal/socket"
+
+// JournaldConfig configures a JournaldHook.
+type JournaldConfig struct {
+	// Socket is the journald socket, DefaultJournaldSocket when empty.
+	Socket string
+
+	// SyslogIdentifier identifies the program, the service field or the
+	// program name when empty.
+	SyslogIdentifier string
+
+	// Formatter collects the fields like the JSON output does.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels sent, all of them when nil.
+	LogLevels []log.Level
+}
+
+// JournaldHook sends entries to systemd-journald with its native protocol.
+// Fields are sent as uppercase journal fields, entries too large for a
+// datagram are passed in a sealed memfd.
+type JournaldHook struct {
+	config JournaldConfig
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// NewJournaldHook returns a hook sending entries to journald.
+func NewJournaldHook(config JournaldConfig) (*JournaldHook, error) {
+	if config.Socket == "" {
+		config.Socket = DefaultJournaldSocket
+	}
+	if config.SyslogIdentifier == "" {
+		config.SyslogIdentifier = filepath.Base(os.Args[0])
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	h := &JournaldHook{config: config}
+	if err := h.dial(); err != nil {
+		return nil, fmt.Errorf("epiclogger: can't connect to journald: %v", err)
+	}
+	return h, nil
+}
+
+// dial connects to the journald socket, replacing the current connection.
+func (h *JournaldHook) dial() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: h.config.Socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	h.conn = conn
+	return nil
+}
+
+// Levels implements logrus.Hook.
+func (h *JournaldHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook. The hook connects again once when journald
+// restarted since the last entry.
+func (h *JournaldHook) Fire(entry *log.Entry) error {
+	data, err := h.encode(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = h.send(data)
+	if err != nil && isJournaldGone(err) {
+		if h.dial() != nil {
+			return err
+		}
+		err = h.send(data)
+	}
+	return err
+}
+
+func (h *JournaldHook) send(data []byte) error {
+	_, err := h.conn.Write(data)
+	if err != nil && isMessageTooLarge(err) {
+		err = sendFile(h.conn, data)
+	}
+	return err
+}
+
+// Close closes the connection to journald.
+func (h *JournaldHook) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conn.Close()
+}
+
+// journaldReserved are the fields set by the hook, entry fields with the
+// same name are prefixed.
+var journaldReserved = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"SYSLOG_IDENTIFIER": true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+}
+
+func (h *JournaldHook) encode(entry *log.Entry) ([]byte, error) {
+	data, httpReq, err := h.config.Formatter.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+	if httpReq != nil {
+		data["httpRequest"] = httpReq
+	}
+
+	b := &bytes.Buffer{}
+	writeJournalField(b, "MESSAGE", entry.Message)
+	writeJournalField(b, "PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	identifier := h.config.SyslogIdentifier
+	if service, ok := data["service"].(string); ok {
+		identifier = service
+	}
+	writeJournalField(b, "SYSLOG_IDENTIFIER", identifier)
+	if caller, ok := data["caller"].(stack.Frame); ok {
+		writeJournalField(b, "CODE_FILE", caller.File)
+		writeJournalField(b, "CODE_LINE", strconv.Itoa(caller.Line))
+		writeJournalField(b, "CODE_FUNC", caller.Name)
+		delete(data, "caller")
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := journalFieldName(k)
+		if name == "" {
+			continue
+		}
+		writeJournalField(b, name, paramValue(data[k]))
+	}
+	return b.Bytes(), nil
+}
+
+// journalFieldName turns key into a valid journal field name: uppercase
+// letters, digits and underscores, not starting with a digit or an
+// underscore, and at most 64 characters.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if journaldReserved[name] {
+		name = "FIELDS_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// writeJournalField writes KEY=value, or the binary-safe form for values
+// containing a newline.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.WriteString(value)
+	} else {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+}
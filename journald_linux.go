@@ -0,0 +1,82 @@
+package epiclogger
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func isMessageTooLarge(err error) bool {
+	err = syscallError(err)
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// isJournaldGone reports whether the socket journald listened on is closed
+// or removed, when journald restarts for instance.
+func isJournaldGone(err error) bool {
+	err = syscallError(err)
+	return err == syscall.ECONNREFUSED || err == syscall.ENOENT || err == syscall.ENOTCONN
+}
+
+func syscallError(err error) error {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err
+}
+
+// sendFile passes data to journald in a sealed memfd, or an unlinked file in
+// /dev/shm on kernels without memfd.
+func sendFile(conn *net.UnixConn, data []byte) error {
+	fd, err := unix.MemfdCreate("journal-message", unix.MFD_ALLOW_SEALING|unix.MFD_CLOEXEC)
+	if err != nil {
+		return sendTempFile(conn, data)
+	}
+	file := os.NewFile(uintptr(fd), "journal-message")
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(file.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		return err
+	}
+	return sendFd(conn, int(file.Fd()))
+}
+
+func sendTempFile(conn *net.UnixConn, data []byte) error {
+	file, err := ioutil.TempFile("/dev/shm", "journal-message")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return sendFd(conn, int(file.Fd()))
+}
+
+// sendFd passes fd over conn. WriteMsgUnix refuses connected datagram
+// sockets so sendmsg is called directly.
+func sendFd(conn *net.UnixConn, fd int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = raw.Write(func(s uintptr) bool {
+		sendErr = unix.Sendmsg(int(s), nil, unix.UnixRights(fd), nil, 0)
+		return sendErr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
@@ -0,0 +1,140 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/stack"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenJournald(t *testing.T) (*net.UnixConn, string) {
+	dir, err := ioutil.TempDir("", "journald")
+	assert.NoError(t, err)
+	socket := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn, socket
+}
+
+// parseJournalFields decodes the fields of a native protocol message.
+func parseJournalFields(t *testing.T, data []byte) map[string]string {
+	fields := map[string]string{}
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		assert.True(t, i > 0)
+		name := string(data[:i])
+		if data[i] == '=' {
+			end := bytes.IndexByte(data, '\n')
+			fields[name] = string(data[i+1 : end])
+			data = data[end+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[i+1 : i+9])
+		fields[name] = string(data[i+9 : i+9+int(size)])
+		data = data[i+9+int(size)+1:]
+	}
+	return fields
+}
+
+func TestJournaldHook(t *testing.T) {
+	listener, socket := listenJournald(t)
+	defer os.RemoveAll(filepath.Dir(socket))
+	defer listener.Close()
+
+	hook, err := NewJournaldHook(JournaldConfig{Socket: socket, SyslogIdentifier: "app"})
+	assert.NoError(t, err)
+	defer hook.Close()
+
+	entry := logrus.WithFields(logrus.Fields{
+		"caller":   stack.Frame{File: "main.go", Line: 42, Name: "main.run"},
+		"user-id":  7,
+		"message":  "clash",
+		"multline": "a\nb",
+	})
+	entry.Level = logrus.WarnLevel
+	entry.Message = "disk almost full"
+	assert.NoError(t, hook.Fire(entry))
+
+	buf := make([]byte, 4096)
+	n, err := listener.Read(buf)
+	assert.NoError(t, err)
+	fields := parseJournalFields(t, buf[:n])
+	assert.Equal(t, "disk almost full", fields["MESSAGE"])
+	assert.Equal(t, "4", fields["PRIORITY"])
+	assert.Equal(t, "app", fields["SYSLOG_IDENTIFIER"])
+	assert.Equal(t, "main.go", fields["CODE_FILE"])
+	assert.Equal(t, "42", fields["CODE_LINE"])
+	assert.Equal(t, "main.run", fields["CODE_FUNC"])
+	assert.Equal(t, "7", fields["USER_ID"])
+	assert.Equal(t, "clash", fields["FIELDS_MESSAGE"])
+	assert.Equal(t, "a\nb", fields["MULTLINE"])
+}
+
+func TestJournaldHookLargeEntry(t *testing.T) {
+	listener, socket := listenJournald(t)
+	defer os.RemoveAll(filepath.Dir(socket))
+	defer listener.Close()
+
+	hook, err := NewJournaldHook(JournaldConfig{Socket: socket})
+	assert.NoError(t, err)
+	defer hook.Close()
+
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	entry.Level = logrus.InfoLevel
+	entry.Message = strings.Repeat("x", 1024*1024)
+	assert.NoError(t, hook.Fire(entry))
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := listener.ReadMsgUnix(make([]byte, 16), oob)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	assert.NoError(t, err)
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	assert.NoError(t, err)
+	file := os.NewFile(uintptr(fds[0]), "journal-message")
+	defer file.Close()
+	file.Seek(0, 0)
+	data, err := ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, entry.Message, parseJournalFields(t, data)["MESSAGE"])
+}
+
+func TestJournaldHookRestart(t *testing.T) {
+	listener, socket := listenJournald(t)
+	defer os.RemoveAll(filepath.Dir(socket))
+
+	hook, err := NewJournaldHook(JournaldConfig{Socket: socket})
+	assert.NoError(t, err)
+	defer hook.Close()
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	entry.Level = logrus.InfoLevel
+	entry.Message = "before"
+	assert.NoError(t, hook.Fire(entry))
+
+	// journald restarts on a new socket at the same path
+	listener.Close()
+	os.Remove(socket)
+	listener, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer listener.Close()
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	entry.Message = "after"
+	assert.NoError(t, hook.Fire(entry))
+	buf := make([]byte, 4096)
+	n, err := listener.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "after", parseJournalFields(t, buf[:n])["MESSAGE"])
+}
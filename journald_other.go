@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package epiclogger
+
+import (
+	"errors"
+	"net"
+)
+
+func isMessageTooLarge(err error) bool {
+	return false
+}
+
+func isJournaldGone(err error) bool {
+	return false
+}
+
+func sendFile(conn *net.UnixConn, data []byte) error {
+	return errors.New("epiclogger: passing entries in a file is only supported on linux")
+}
@@ -4,21 +4,119 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/facebookgo/stack"
-	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	errorReporting "google.golang.org/api/clouderrorreporting/v1beta1"
 	logging "google.golang.org/api/logging/v2beta1"
-	"google.golang.org/grpc/metadata"
 )
 
+// errorNoteKey is the field where the formatters explain what they had to
+// change or drop to be able to emit an entry.
+const errorNoteKey = "epicloggerError"
+
+// formatterFailures counts the entries EpicFormatter failed to marshal and
+// emitted with the fallback payload.
+var formatterFailures uint64
+
 // EpicFormatter is similar to logrus.JSONFormatter but with log level that are recongnized
 // by kubernetes fluentd.
-type EpicFormatter struct{}
+type EpicFormatter struct {
+	// Encoder renders struct, map and slice field values. Uses a shared
+	// FieldEncoder with DefaultMaxDepth when nil.
+	Encoder *FieldEncoder
+
+	// MaxEntryBytes is the budget for a whole serialized entry, the largest
+	// fields are truncated until the entry fits. DefaultMaxEntryBytes when
+	// zero, no limit when negative.
+	MaxEntryBytes int
+
+	// MaxFieldBytes is the budget for a single string value.
+	// DefaultMaxFieldBytes when zero, no limit when negative.
+	MaxFieldBytes int
+
+	// MaxArrayLen is the maximum number of items logged from a slice or array.
+	// DefaultMaxArrayLen when zero, no limit when negative.
+	MaxArrayLen int
+
+	// FieldMap renames the fields written by the formatter.
+	FieldMap FieldMap
+
+	// ClashPolicy decides what happens to user fields named like one of the
+	// fields written by the formatter. ClashPrefix by default.
+	ClashPolicy ClashPolicy
+
+	// ClashPrefix is used by the ClashPrefix policy, DefaultClashPrefix when empty.
+	ClashPrefix string
+
+	// ContextExtractors read the fields logged for a context passed to WithCtx.
+	// DefaultContextExtractors when nil. Loggers returned by
+	// EpicLogger.WithContextExtractors use their own extractors instead.
+	ContextExtractors []ContextExtractor
+
+	// ErrorReportingFields are the fields lifted into the Error Reporting
+	// serviceContext and context of error entries, out of service, version,
+	// caller, user and stack. Fields not listed are logged as-is.
+	// All of them when nil.
+	ErrorReportingFields []string
+}
+
+func (f *EpicFormatter) contextExtractors() []ContextExtractor {
+	if f.ContextExtractors != nil {
+		return f.ContextExtractors
+	}
+	return DefaultContextExtractors(f.FieldMap)
+}
+
+// extractContext returns the fields read from ctx by the ContextExtractors,
+// or by the extractors of the EpicLogger ctx was logged with.
+func (f *EpicFormatter) extractContext(ctx context.Context) log.Fields {
+	extractors := f.contextExtractors()
+	if lc, ok := ctx.(*loggerContext); ok {
+		ctx, extractors = lc.Context, lc.extractors
+	}
+	fields := log.Fields{}
+	for _, extractor := range extractors {
+		extractor.Extract(ctx, fields)
+	}
+	return fields
+}
+
+func (f *EpicFormatter) errorReportingFields() []string {
+	if f.ErrorReportingFields != nil {
+		return f.ErrorReportingFields
+	}
+	return defaultErrorReportingFields
+}
+
+// reservedKeys are the keys written by the formatter. withContext adds the
+// keys set from the contexts, which the user fields can't clash with either.
+func (f *EpicFormatter) reservedKeys(withContext bool) []string {
+	keys := []string{
+		f.FieldMap.resolve(FieldKeyTime),
+		f.FieldMap.resolve(FieldKeyMessage),
+		f.FieldMap.resolve(FieldKeySeverity),
+		f.FieldMap.resolve(FieldKeyHTTPRequest),
+		truncatedKey,
+		errorNoteKey,
+	}
+	if withContext {
+		keys = append(keys, f.FieldMap.resolve(FieldKeyUserID), f.FieldMap.resolve(FieldKeyCorrelationID))
+	}
+	return keys
+}
+
+func (f *EpicFormatter) fieldEncoder() *FieldEncoder {
+	if f.Encoder != nil {
+		return f.Encoder
+	}
+	return defaultFieldEncoder
+}
 
 func isError(entry *log.Entry) bool {
 	if entry != nil {
@@ -34,15 +132,6 @@ func isError(entry *log.Entry) bool {
 	return false
 }
 
-func retrieveMetaData(ctx context.Context) (data map[string][]string) {
-	var ok bool
-	data, ok = metadata.FromContext(ctx)
-	if !ok {
-		fmt.Println("Failed to retrieve metadata")
-	}
-	return
-}
-
 func contains(item string, array []string) bool {
 	for _, v := range array {
 		if item == v {
@@ -52,20 +141,6 @@ func contains(item string, array []string) bool {
 	return false
 }
 
-func prefixFieldClashes(data log.Fields) {
-	if t, ok := data["time"]; ok {
-		data["fields.time"] = t
-	}
-
-	if m, ok := data["message"]; ok {
-		data["fields.message"] = m
-	}
-
-	if l, ok := data["severity"]; ok {
-		data["fields.severity"] = l
-	}
-}
-
 func getSeverity(level log.Level) string {
 	switch level {
 	case log.FatalLevel:
@@ -79,9 +154,62 @@ func getSeverity(level log.Level) string {
 
 // Format the log entry. Implements logrus.Formatter.
 func (f *EpicFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data, httpReq, err := f.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := f.preparePayload(entry, data, httpReq)
+	serialized, err := f.marshalWithinBudget(payload)
+	if err != nil {
+		atomic.AddUint64(&formatterFailures, 1)
+		// Never lose the entry: emit what we know for sure can be marshaled.
+		serialized, err = json.Marshal(f.fallbackPayload(entry, data, err))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+		}
+	}
+	return append(serialized, '\n'), nil
+}
+
+// FormatMap returns the payload Format serializes, for the sinks encoding
+// entries themselves. The field budgets apply but not MaxEntryBytes.
+func (f *EpicFormatter) FormatMap(entry *log.Entry) (map[string]interface{}, error) {
+	data, httpReq, err := f.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := f.preparePayload(entry, data, httpReq)
+	t := f.truncator()
+	for k, v := range payload {
+		payload[k] = t.truncate(k, v)
+	}
+	if t.truncated {
+		payload[truncatedKey] = true
+	}
+	return payload, nil
+}
+
+// collectFields normalizes the entry fields and pulls out the http request
+// and context information they carry.
+func (f *EpicFormatter) collectFields(entry *log.Entry) (log.Fields, *logging.HttpRequest, error) {
 	data := make(log.Fields, len(entry.Data)+3)
 	var httpReq *logging.HttpRequest
+	var problems []string
+	fields := make(log.Fields, len(entry.Data))
 	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	if err := resolveFieldClashes(fields, f.reservedKeys(true), f.ClashPolicy, f.ClashPrefix); err != nil {
+		return nil, nil, err
+	}
+	extracted := log.Fields{}
+	for k, v := range fields {
+		if isNilPointer(reflect.ValueOf(v)) {
+			data[k] = nil
+			continue
+		}
 		switch x := v.(type) {
 		case error:
 			// Otherwise errors are ignored by `encoding/json`
@@ -99,54 +227,121 @@ func (f *EpicFormatter) Format(entry *log.Entry) ([]byte, error) {
 		case *logging.HttpRequest:
 			httpReq = x
 
-		case context.Context:
-			metaData := retrieveMetaData(x)
-			if authorID, ok := metaData["author_id"]; ok {
-				data["userId"] = authorID[0]
-			}
+		case stack.Frame, stack.Stack:
+			data[k] = v
 
-			if authorName, ok := metaData["author_name"]; ok {
-				data["user"] = authorName[0]
+		case context.Context:
+			for key, value := range f.extractContext(x) {
+				extracted[key] = value
 			}
 
-			if correlationID, ok := metaData["correlation_id"]; ok {
-				data["correlationId"] = correlationID[0]
-			}
-			for key, value := range grpc_ctxtags.Extract(x).Values() {
-				data[key] = fmt.Sprintf("%v", value)
+		default:
+			value, notes := f.fieldEncoder().Normalize(v)
+			data[k] = value
+			for _, note := range notes {
+				problems = append(problems, k+": "+note)
 			}
+		}
+	}
 
-		default:
-			data[k] = v
+	// the fields from the contexts win over the user fields, but not over
+	// the ones written by the formatter
+	if err := resolveFieldClashes(extracted, f.reservedKeys(false), f.ClashPolicy, f.ClashPrefix); err != nil {
+		return nil, nil, err
+	}
+	for key, value := range extracted {
+		value, notes := f.fieldEncoder().Normalize(value)
+		data[key] = value
+		for _, note := range notes {
+			problems = append(problems, key+": "+note)
 		}
 	}
 
-	if data["grpc.method"] != nil {
+	if len(problems) > 0 {
+		data[errorNoteKey] = strings.Join(problems, "; ")
+	}
+
+	if method, ok := data["grpc.method"].(string); ok {
 		httpReq = &logging.HttpRequest{
 			RequestMethod: "POST",
-			RequestUrl:    data["grpc.method"].(string),
+			RequestUrl:    method,
 		}
 	}
+	return data, httpReq, nil
+}
+
+func limit(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func (f *EpicFormatter) truncator() *truncator {
+	return &truncator{
+		maxFieldBytes: limit(f.MaxFieldBytes, DefaultMaxFieldBytes),
+		maxArrayLen:   limit(f.MaxArrayLen, DefaultMaxArrayLen),
+		messageKey:    f.FieldMap.resolve(FieldKeyMessage),
+		untruncatable: []string{
+			f.FieldMap.resolve(FieldKeyTime),
+			f.FieldMap.resolve(FieldKeySeverity),
+			truncatedKey,
+		},
+	}
+}
+
+// marshalWithinBudget serializes the payload, truncating fields that go over
+// the formatter's byte budgets. A `truncated: true` field is added when
+// anything had to be cut.
+func (f *EpicFormatter) marshalWithinBudget(payload map[string]interface{}) ([]byte, error) {
+	t := f.truncator()
+	for k, v := range payload {
+		payload[k] = t.truncate(k, v)
+	}
+	if t.truncated {
+		payload[truncatedKey] = true
+	}
 
-	prefixFieldClashes(data)
-	payload := preparePayload(entry, data, httpReq)
 	serialized, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+	maxEntryBytes := limit(f.MaxEntryBytes, DefaultMaxEntryBytes)
+	// the trailing newline counts towards the budget too
+	for attempts := 0; err == nil && maxEntryBytes > 0 && len(serialized)+1 > maxEntryBytes && attempts < len(payload)*4; attempts++ {
+		if !t.shrink(payload, len(serialized)+1-maxEntryBytes) {
+			break
+		}
+		payload[truncatedKey] = true
+		serialized, err = json.Marshal(payload)
 	}
-	return append(serialized, '\n'), nil
+	return serialized, err
 }
 
-func preparePayload(entry *log.Entry, data log.Fields, httpReq *logging.HttpRequest) map[string]interface{} {
-	data["time"] = entry.Time.Format(time.RFC3339)
-	data["message"] = entry.Message
-	data["severity"] = getSeverity(entry.Level)
+func (f *EpicFormatter) fallbackPayload(entry *log.Entry, data log.Fields, err error) map[string]interface{} {
+	payload := map[string]interface{}{
+		f.FieldMap.resolve(FieldKeyTime):     entry.Time.Format(time.RFC3339),
+		f.FieldMap.resolve(FieldKeyMessage):  entry.Message,
+		f.FieldMap.resolve(FieldKeySeverity): getSeverity(entry.Level),
+		errorNoteKey:                         fmt.Sprintf("Failed to marshal fields to JSON, %v", err),
+	}
+	for _, k := range []string{"service", "version"} {
+		if v, ok := data[k].(string); ok {
+			payload[k] = v
+		}
+	}
+	return payload
+}
+
+func (f *EpicFormatter) preparePayload(entry *log.Entry, data log.Fields, httpReq *logging.HttpRequest) map[string]interface{} {
+	messageKey := f.FieldMap.resolve(FieldKeyMessage)
+	data[f.FieldMap.resolve(FieldKeyTime)] = entry.Time.Format(time.RFC3339)
+	data[messageKey] = entry.Message
+	data[f.FieldMap.resolve(FieldKeySeverity)] = getSeverity(entry.Level)
 	// The error reporting payload JSON schema is defined in:
 	// https://cloud.google.com/error-reporting/docs/formatting-error-messages
 	// Which reflects the structure of the ErrorEvent type in:
 	// https://godoc.org/google.golang.org/api/clouderrorreporting/v1beta1
 	if isError(entry) {
-		errorEvent := buildErrorReportingEvent(entry, data, httpReq)
+		lifted := f.errorReportingFields()
+		errorEvent := buildErrorReportingEvent(entry, data, httpReq, lifted)
 		errorStructPayload, err := json.Marshal(errorEvent)
 		if err != nil {
 			log.Printf("error marshaling error reporting data: %s", err.Error())
@@ -156,44 +351,49 @@ func preparePayload(entry *log.Entry, data log.Fields, httpReq *logging.HttpRequ
 		if err != nil {
 			log.Printf("error parsing error reporting data: %s", err.Error())
 		}
+		// The event already carries the message, under the key Error Reporting expects.
 		for k, v := range data {
-			if !contains(k, []string{"service", "version", "caller", "user", "stack", "message"}) {
+			if k != messageKey && !contains(k, lifted) {
 				errorJSONPayload[k] = v
 			}
 		}
 		return errorJSONPayload
 	}
 	if httpReq != nil {
-		data["httpRequest"] = httpReq
+		data[f.FieldMap.resolve(FieldKeyHTTPRequest)] = httpReq
 	}
 	return data
 }
 
-func buildErrorReportingEvent(entry *log.Entry, data log.Fields, httpReq *logging.HttpRequest) errorReporting.ReportedErrorEvent {
+func buildErrorReportingEvent(entry *log.Entry, data log.Fields, httpReq *logging.HttpRequest, lifted []string) errorReporting.ReportedErrorEvent {
 	errorEvent := errorReporting.ReportedErrorEvent{
 		EventTime:      entry.Time.Format(time.RFC3339),
 		Message:        entry.Message,
 		ServiceContext: &errorReporting.ServiceContext{},
 		Context:        &errorReporting.ErrorContext{},
 	}
-	if data["service"] != nil {
-		errorEvent.ServiceContext.Service = data["service"].(string)
+	if service, ok := data["service"].(string); ok && contains("service", lifted) {
+		errorEvent.ServiceContext.Service = service
 	}
-	if data["version"] != nil {
-		errorEvent.ServiceContext.Version = data["version"].(string)
+	if version, ok := data["version"].(string); ok && contains("version", lifted) {
+		errorEvent.ServiceContext.Version = version
 	}
-	if data["stack"] != nil {
-		errorEvent.Message += data["stack"].(stack.Stack).String()
+	if contains("stack", lifted) {
+		switch st := data["stack"].(type) {
+		case stack.Stack:
+			errorEvent.Message += st.String()
+		case string:
+			errorEvent.Message += st
+		}
 	}
 
-	if data["user"] != nil {
-		errorEvent.Context.User = data["user"].(string)
+	if user, ok := data["user"].(string); ok && contains("user", lifted) {
+		errorEvent.Context.User = user
 	}
 	// Assumes that caller stack frame information of type
 	// github.com/facebookgo/stack.Frame has been added.
 	// Possibly via a library like github.com/Gurpartap/logrus-stack
-	if entry.Data["caller"] != nil {
-		caller := entry.Data["caller"].(stack.Frame)
+	if caller, ok := entry.Data["caller"].(stack.Frame); ok && contains("caller", lifted) {
 		errorEvent.Context.ReportLocation = &errorReporting.SourceLocation{
 			FilePath:     caller.File,
 			FunctionName: caller.Name,
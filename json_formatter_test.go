@@ -3,10 +3,13 @@ package epiclogger
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 var epicLogger = WithFields(map[string]interface{}{"service": "test-service", "version": "123"})
@@ -150,3 +153,254 @@ func TestJSONEntryEndsWithNewline(t *testing.T) {
 		t.Fatal("Expected JSON log entry to end with a newline")
 	}
 }
+
+func TestOddValuesDoNotLoseEntry(t *testing.T) {
+	formatter := &EpicFormatter{}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	b, err := formatter.Format(epicLogger.WithFields(map[string]interface{}{
+		"nan":    math.NaN(),
+		"inf":    math.Inf(1),
+		"chan":   make(chan int),
+		"func":   func() {},
+		"cyclic": cyclic,
+	}).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["nan"] != "NaN" || entry["inf"] != "+Inf" {
+		t.Fatal("float values not normalized: ", entry["nan"], entry["inf"])
+	}
+	if entry["chan"] != "chan int" || entry["func"] != "func()" {
+		t.Fatal("unsupported types not normalized: ", entry["chan"], entry["func"])
+	}
+	if entry["cyclic"].(map[string]interface{})["self"] != cycleValue {
+		t.Fatal("cycle not normalized: ", entry["cyclic"])
+	}
+	if entry["epicloggerError"] == nil {
+		t.Fatal("epicloggerError not set")
+	}
+}
+
+func TestValuesRenderedConsistently(t *testing.T) {
+	formatter := &EpicFormatter{}
+
+	b, err := formatter.Format(epicLogger.WithFields(map[string]interface{}{
+		"time":     time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC),
+		"duration": 1500 * time.Millisecond,
+		"bytes":    []byte("hi"),
+		"proto":    durationpb.New(2 * time.Second),
+	}).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["fields.time"] != "2017-10-01T12:00:00Z" {
+		t.Fatal("time not rendered as RFC3339, was: ", entry["fields.time"])
+	}
+	if entry["duration"] != "1.5s" {
+		t.Fatal("duration not rendered as string, was: ", entry["duration"])
+	}
+	if entry["bytes"] != "aGk=" {
+		t.Fatal("bytes not rendered as base64, was: ", entry["bytes"])
+	}
+	if entry["proto"] != "2s" {
+		t.Fatal("proto message not rendered with protojson, was: ", entry["proto"])
+	}
+	if entry["epicloggerError"] != nil {
+		t.Fatal("unexpected epicloggerError: ", entry["epicloggerError"])
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	formatter := &EpicFormatter{FieldMap: FieldMap{
+		FieldKeyTime:     "@timestamp",
+		FieldKeySeverity: "@level",
+		FieldKeyUserID:   "uid",
+	}}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("author_id", "this_author_id"))
+	b, err := formatter.Format(epicLogger.WithCtx(ctx).WithField("@level", "mine").Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["@timestamp"] != "0001-01-01T00:00:00Z" || entry["time"] != nil {
+		t.Fatal("time field not renamed, was: ", entry["@timestamp"])
+	}
+	if entry["@level"] != "CRITICAL" || entry["fields.@level"] != "mine" {
+		t.Fatal("severity field not renamed or clash not prefixed")
+	}
+	if entry["uid"] != "this_author_id" {
+		t.Fatal("userId field not renamed, was: ", entry["uid"])
+	}
+}
+
+func TestClashPolicies(t *testing.T) {
+	formatter := &EpicFormatter{ClashPolicy: ClashDrop}
+
+	b, err := formatter.Format(epicLogger.WithField("message", "something").Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["fields.message"] != nil || entry["message"] == "something" {
+		t.Fatal("clashing field not dropped")
+	}
+
+	formatter = &EpicFormatter{ClashPolicy: ClashError}
+	if _, err := formatter.Format(epicLogger.WithField("message", "something").Entry); err == nil {
+		t.Fatal("Expected an error for a clashing field")
+	}
+}
+
+func TestContextFieldClashes(t *testing.T) {
+	formatter := &EpicFormatter{ContextExtractors: append(
+		DefaultContextExtractors(nil),
+		MetadataField("x-message", "message"),
+	)}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"author_id", "this_author_id",
+		"x-message", "from the context",
+	))
+	b, err := formatter.Format(epicLogger.WithCtx(ctx).WithField("userId", "mine").Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["userId"] != "this_author_id" || entry["fields.userId"] != "mine" {
+		t.Fatal("userId field clash not prefixed")
+	}
+	if entry["message"] == "from the context" || entry["fields.message"] != "from the context" {
+		t.Fatal("context field clash not prefixed")
+	}
+}
+
+func TestErrorReportingFields(t *testing.T) {
+	formatter := &EpicFormatter{ErrorReportingFields: []string{"version"}}
+
+	b, err := formatter.Format(epicLogger.Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["service"] != "test-service" || entry["version"] != nil {
+		t.Fatal("only version should be lifted, service was: ", entry["service"])
+	}
+	serviceContext := entry["serviceContext"].(map[string]interface{})
+	if serviceContext["version"] != "123" || serviceContext["service"] != nil {
+		t.Fatal("serviceContext not limited to version, was: ", serviceContext)
+	}
+}
+
+type tenantKey struct{}
+
+func TestCustomContextExtractors(t *testing.T) {
+	formatter := &EpicFormatter{ContextExtractors: []ContextExtractor{
+		MetadataField("x-request-id", "requestId"),
+		MetadataPrefix("x-tenant-"),
+		ContextValue(tenantKey{}, "tenant"),
+	}}
+
+	ctx := metadata.NewIncomingContext(
+		context.Background(),
+		metadata.Pairs(
+			"author_id", "this_author_id",
+			"x-request-id", "req-1",
+			"x-tenant-id", "acme",
+			"x-tenant-region", "eu",
+		),
+	)
+	ctx = context.WithValue(ctx, tenantKey{}, struct {
+		Plan string `log:"plan"`
+	}{"gold"})
+	b, err := formatter.Format(epicLogger.WithCtx(ctx).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if entry["userId"] != nil {
+		t.Fatal("default extractors used alongside custom ones")
+	}
+	if entry["requestId"] != "req-1" {
+		t.Fatal("requestId field not set, was: ", entry["requestId"])
+	}
+	if entry["x-tenant-id"] != "acme" || entry["x-tenant-region"] != "eu" {
+		t.Fatal("prefixed metadata fields not set")
+	}
+	if entry["tenant"].(map[string]interface{})["plan"] != "gold" {
+		t.Fatal("context value not set, was: ", entry["tenant"])
+	}
+}
+
+func TestLoggerContextExtractors(t *testing.T) {
+	formatter := &EpicFormatter{}
+	requests := epicLogger.WithContextExtractors(MetadataField("x-request-id", "requestId"))
+	tenants := epicLogger.WithContextExtractors(MetadataField("x-tenant-id", "tenant"))
+
+	ctx := metadata.NewIncomingContext(
+		context.Background(),
+		metadata.Pairs("author_id", "this_author_id", "x-request-id", "req-1", "x-tenant-id", "acme"),
+	)
+	for _, test := range []struct {
+		logger  *EpicLogger
+		field   string
+		value   string
+		missing string
+	}{
+		{requests.WithField("a", 1), "requestId", "req-1", "tenant"},
+		{tenants, "tenant", "acme", "requestId"},
+		{epicLogger, "userId", "this_author_id", "requestId"},
+	} {
+		b, err := formatter.Format(test.logger.WithCtx(ctx).Entry)
+		if err != nil {
+			t.Fatal("Unable to format entry: ", err)
+		}
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(b, &entry); err != nil {
+			t.Fatal("Unable to unmarshal formatted entry: ", err)
+		}
+		if entry[test.field] != test.value {
+			t.Fatalf("%s field not set, was: %v", test.field, entry[test.field])
+		}
+		if _, ok := entry[test.missing]; ok {
+			t.Fatalf("%s field set by another logger's extractors", test.missing)
+		}
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 var (
 	// baseLogger is the name of the standard logger in baseLoggerlib `log`
-	baseLogger = &EpicLogger{log.NewEntry(log.New())}
+	baseLogger = &EpicLogger{Entry: log.NewEntry(log.New())}
 	contextKey = "context"
 )
 
@@ -24,7 +24,7 @@ func Base() *EpicLogger {
 func NewEpicLogger(w io.Writer) EpicLogger {
 	l := log.New()
 	l.Out = w
-	return EpicLogger{log.NewEntry(l)}
+	return EpicLogger{Entry: log.NewEntry(l)}
 }
 
 func SetFormatter(formatter log.Formatter) {
@@ -43,22 +43,37 @@ func AddHook(hook log.Hook) {
 
 type EpicLogger struct {
 	*log.Entry
+
+	extractors []ContextExtractor
+}
+
+// WithContextExtractors returns a logger whose contexts passed to WithCtx are
+// read by extractors, instead of the ContextExtractors of the formatter.
+func (e *EpicLogger) WithContextExtractors(extractors ...ContextExtractor) *EpicLogger {
+	return &EpicLogger{Entry: e.Entry, extractors: extractors}
 }
 
 func (e *EpicLogger) WithCtx(ctx context.Context) *EpicLogger {
-	return &EpicLogger{e.Entry.WithField(contextKey, ctx)}
+	if e.extractors != nil {
+		ctx = &loggerContext{Context: ctx, extractors: e.extractors}
+	}
+	return e.with(e.Entry.WithField(contextKey, ctx))
 }
 
 func (e *EpicLogger) WithField(key string, value interface{}) *EpicLogger {
-	return &EpicLogger{e.Entry.WithField(key, value)}
+	return e.with(e.Entry.WithField(key, value))
 }
 
 func (e *EpicLogger) WithError(err error) *EpicLogger {
-	return &EpicLogger{e.Entry.WithError(err)}
+	return e.with(e.Entry.WithError(err))
 }
 
 func (e *EpicLogger) WithFields(fields log.Fields) *EpicLogger {
-	return &EpicLogger{e.Entry.WithFields(fields)}
+	return e.with(e.Entry.WithFields(fields))
+}
+
+func (e *EpicLogger) with(entry *log.Entry) *EpicLogger {
+	return &EpicLogger{Entry: entry, extractors: e.extractors}
 }
 
 func (e *EpicLogger) addServiceContext() *EpicLogger {
@@ -0,0 +1,325 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultLokiLabelFields are the fields turned into stream labels by default.
+var DefaultLokiLabelFields = []string{"service", "version", "severity"}
+
+// LokiConfig configures a LokiHook.
+type LokiConfig struct {
+	// URL is the Loki base URL, the entries are pushed to URL/loki/api/v1/push.
+	URL string
+
+	// TenantID is sent as X-Scope-OrgID to multi-tenant Loki.
+	TenantID string
+
+	// Protobuf pushes snappy compressed protobuf instead of JSON.
+	Protobuf bool
+
+	// Labels are added to every stream.
+	Labels map[string]string
+
+	// LabelFields are the fields turned into stream labels, and left out of
+	// the line. DefaultLokiLabelFields when nil. Keep them to a handful of
+	// low cardinality values, every combination is a Loki stream.
+	LabelFields []string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter builds the line of each entry.
+	Formatter *EpicFormatter
+
+	// AdjustOutOfOrder moves the entries older than the last one pushed on
+	// their stream up to its time, for the Loki versions rejecting out of
+	// order entries. They keep their time otherwise.
+	AdjustOutOfOrder bool
+
+	// LogLevels are the levels pushed, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound the pushes.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// pushed, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed pushes.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// LokiHook pushes entries to Grafana Loki.
+type LokiHook struct {
+	config LokiConfig
+	url    string
+	retry  *retryPolicy
+	batchSink
+
+	mu       sync.Mutex
+	lastSent map[string]*lokiLastSent
+}
+
+// lokiStreamIdle is how long the last time pushed on a stream is kept after
+// its last push.
+const lokiStreamIdle = time.Hour
+
+// lokiLastSent is the time of the last entry pushed on a stream, and when it
+// was pushed.
+type lokiLastSent struct {
+	time   time.Time
+	pushed time.Time
+}
+
+type lokiEntry struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+type lokiStream struct {
+	key     string
+	labels  map[string]string
+	entries []*lokiEntry
+}
+
+// NewLokiHook returns a hook pushing entries in the background. Close it
+// before exiting to push the last entries.
+func NewLokiHook(config LokiConfig) (*LokiHook, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("epiclogger: a Loki URL is required")
+	}
+	if config.LabelFields == nil {
+		config.LabelFields = DefaultLokiLabelFields
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	h := &LokiHook{
+		config:   config,
+		url:      strings.TrimSuffix(config.URL, "/") + "/loki/api/v1/push",
+		retry:    newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+		lastSent: map[string]*lokiLastSent{},
+	}
+	h.start("loki", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.push)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *LokiHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *LokiHook) Fire(entry *log.Entry) error {
+	e, err := h.entry(entry)
+	if err != nil {
+		return err
+	}
+	return h.queue(entry, e, len(e.line))
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// labelName turns a field name into a valid Prometheus label name.
+func labelName(field string) string {
+	name := invalidLabelChars.ReplaceAllString(field, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func (h *LokiHook) entry(entry *log.Entry) (*lokiEntry, error) {
+	payload, err := h.config.Formatter.FormatMap(entry)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(h.config.Labels)+len(h.config.LabelFields))
+	for k, v := range h.config.Labels {
+		labels[labelName(k)] = v
+	}
+	for _, field := range h.config.LabelFields {
+		if v, ok := payload[field].(string); ok {
+			labels[labelName(field)] = v
+			delete(payload, field)
+		} else if v, ok := entry.Data[field].(string); ok {
+			// lifted into the error payload, keep it there too
+			labels[labelName(field)] = v
+		}
+	}
+	line, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &lokiEntry{labels: labels, time: entry.Time, line: string(line)}, nil
+}
+
+// streamKey renders labels in the Prometheus selector form the protobuf
+// push uses, which also identifies the stream.
+func streamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, k := range names {
+		parts[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// streams groups the entries by stream, in time order. With
+// AdjustOutOfOrder, the entries older than the last one sent on their stream
+// are moved up to its time.
+func (h *LokiHook) streams(items []interface{}) []*lokiStream {
+	byKey := map[string]*lokiStream{}
+	var streams []*lokiStream
+	for _, item := range items {
+		e := item.(*lokiEntry)
+		key := streamKey(e.labels)
+		s, ok := byKey[key]
+		if !ok {
+			s = &lokiStream{key: key, labels: e.labels}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	for _, s := range streams {
+		sort.SliceStable(s.entries, func(i, j int) bool {
+			return s.entries[i].time.Before(s.entries[j].time)
+		})
+	}
+	if h.config.AdjustOutOfOrder {
+		h.adjust(streams, time.Now())
+	}
+	return streams
+}
+
+// adjust moves the entries of streams older than the last one sent on their
+// stream up to its time, and forgets the streams idle since lokiStreamIdle.
+func (h *LokiHook) adjust(streams []*lokiStream, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, sent := range h.lastSent {
+		if now.Sub(sent.pushed) > lokiStreamIdle {
+			delete(h.lastSent, key)
+		}
+	}
+	for _, s := range streams {
+		sent, ok := h.lastSent[s.key]
+		if !ok {
+			sent = &lokiLastSent{}
+			h.lastSent[s.key] = sent
+		}
+		for _, e := range s.entries {
+			if e.time.Before(sent.time) {
+				e.time = sent.time
+			}
+			sent.time = e.time
+		}
+		sent.pushed = now
+	}
+}
+
+func (h *LokiHook) push(items []interface{}) error {
+	streams := h.streams(items)
+	header := http.Header{}
+	if h.config.TenantID != "" {
+		header.Set("X-Scope-OrgID", h.config.TenantID)
+	}
+	var body []byte
+	if h.config.Protobuf {
+		header.Set("Content-Type", "application/x-protobuf")
+		body = snappy.Encode(nil, encodeLokiPush(streams))
+	} else {
+		header.Set("Content-Type", "application/json")
+		var err error
+		if body, err = json.Marshal(lokiPushJSON(streams)); err != nil {
+			return err
+		}
+	}
+	err := h.retry.do(func() error {
+		_, err := post(h.config.Client, h.url, body, header)
+		return err
+	})
+	// Loki keeps the other entries of the push
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusBadRequest && isOutOfOrder(statusErr.Body) {
+		reportError("loki rejected out of order entries: %s", statusErr.Body)
+		return nil
+	}
+	return err
+}
+
+func isOutOfOrder(body string) bool {
+	return strings.Contains(body, "out of order") || strings.Contains(body, "too far behind")
+}
+
+func lokiPushJSON(streams []*lokiStream) map[string]interface{} {
+	jsonStreams := make([]map[string]interface{}, len(streams))
+	for i, s := range streams {
+		values := make([][2]string, len(s.entries))
+		for j, e := range s.entries {
+			values[j] = [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line}
+		}
+		jsonStreams[i] = map[string]interface{}{"stream": s.labels, "values": values}
+	}
+	return map[string]interface{}{"streams": jsonStreams}
+}
+
+// encodeLokiPush encodes a logproto.PushRequest:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiPush(streams []*lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		var stream []byte
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, s.key)
+		for _, e := range s.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.time.Unix()))
+			if nanos := e.time.Nanosecond(); nanos != 0 {
+				ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+				ts = protowire.AppendVarint(ts, uint64(nanos))
+			}
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, ts)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, e.line)
+
+			stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+			stream = protowire.AppendBytes(stream, entry)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, stream)
+	}
+	return req
+}
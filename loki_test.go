@@ -0,0 +1,149 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type lokiJSONPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+func newLokiEntry(message string, t time.Time) *logrus.Entry {
+	entry := logrus.WithField("service", "api")
+	entry.Level = logrus.InfoLevel
+	entry.Time = t
+	entry.Message = message
+	return entry
+}
+
+func TestLokiHookJSON(t *testing.T) {
+	pushes := make(chan lokiJSONPush, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		assert.Equal(t, "tenant", r.Header.Get("X-Scope-OrgID"))
+		var push lokiJSONPush
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &push)
+		pushes <- push
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	hook, err := NewLokiHook(LokiConfig{URL: server.URL, TenantID: "tenant", Labels: map[string]string{"env": "test"}, AdjustOutOfOrder: true})
+	assert.NoError(t, err)
+	now := time.Unix(1500000000, 0)
+	assert.NoError(t, hook.Fire(newLokiEntry("second", now.Add(time.Second))))
+	assert.NoError(t, hook.Fire(newLokiEntry("first", now)))
+	assert.NoError(t, hook.Flush())
+	// older than what was sent on the stream
+	assert.NoError(t, hook.Fire(newLokiEntry("late", now)))
+	assert.NoError(t, hook.Close())
+
+	push := <-pushes
+	assert.Equal(t, 1, len(push.Streams))
+	stream := push.Streams[0]
+	assert.Equal(t, map[string]string{"env": "test", "service": "api", "severity": "INFO"}, stream.Stream)
+	assert.Equal(t, 2, len(stream.Values))
+	assert.Equal(t, "1500000000000000000", stream.Values[0][0])
+	var line map[string]interface{}
+	json.Unmarshal([]byte(stream.Values[0][1]), &line)
+	assert.Equal(t, "first", line["message"])
+	assert.Nil(t, line["service"])
+	assert.Nil(t, line["severity"])
+
+	push = <-pushes
+	assert.Equal(t, "1500000001000000000", push.Streams[0].Values[0][0])
+}
+
+func TestLokiHookStreamsKeepTime(t *testing.T) {
+	hook, err := NewLokiHook(LokiConfig{URL: "http://loki"})
+	assert.NoError(t, err)
+	defer hook.Close()
+	now := time.Unix(1500000000, 0)
+
+	hook.streams([]interface{}{&lokiEntry{labels: map[string]string{"a": "1"}, time: now}})
+	streams := hook.streams([]interface{}{&lokiEntry{labels: map[string]string{"a": "1"}, time: now.Add(-time.Second)}})
+	assert.Equal(t, now.Add(-time.Second), streams[0].entries[0].time)
+	assert.Empty(t, hook.lastSent)
+}
+
+func TestLokiHookForgetsIdleStreams(t *testing.T) {
+	hook, err := NewLokiHook(LokiConfig{URL: "http://loki", AdjustOutOfOrder: true})
+	assert.NoError(t, err)
+	defer hook.Close()
+	now := time.Unix(1500000000, 0)
+	stream := func(labels map[string]string, t time.Time) *lokiStream {
+		return &lokiStream{key: streamKey(labels), labels: labels, entries: []*lokiEntry{{labels: labels, time: t}}}
+	}
+
+	hook.adjust([]*lokiStream{stream(map[string]string{"a": "1"}, now)}, now)
+	hook.adjust([]*lokiStream{stream(map[string]string{"a": "2"}, now)}, now.Add(lokiStreamIdle))
+	assert.Len(t, hook.lastSent, 2)
+	hook.adjust([]*lokiStream{stream(map[string]string{"a": "2"}, now)}, now.Add(lokiStreamIdle+time.Second))
+	assert.Len(t, hook.lastSent, 1)
+	assert.NotNil(t, hook.lastSent[streamKey(map[string]string{"a": "2"})])
+}
+
+func TestLokiHookProtobuf(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		decoded, err := snappy.Decode(nil, body)
+		assert.NoError(t, err)
+		bodies <- decoded
+	}))
+	defer server.Close()
+
+	hook, err := NewLokiHook(LokiConfig{URL: server.URL, Protobuf: true})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newLokiEntry("hello", time.Unix(1500000000, 5))))
+	assert.NoError(t, hook.Close())
+
+	// PushRequest.streams[0]
+	b := <-bodies
+	num, _, n := protowire.ConsumeTag(b)
+	assert.Equal(t, protowire.Number(1), num)
+	stream, _ := protowire.ConsumeBytes(b[n:])
+	// StreamAdapter.labels
+	_, _, n = protowire.ConsumeTag(stream)
+	labels, m := protowire.ConsumeString(stream[n:])
+	assert.Equal(t, `{service="api", severity="INFO"}`, labels)
+	// StreamAdapter.entries[0].line
+	stream = stream[n+m:]
+	_, _, n = protowire.ConsumeTag(stream)
+	entry, _ := protowire.ConsumeBytes(stream[n:])
+	_, _, n = protowire.ConsumeTag(entry)
+	_, m = protowire.ConsumeBytes(entry[n:])
+	entry = entry[n+m:]
+	_, _, n = protowire.ConsumeTag(entry)
+	line, _ := protowire.ConsumeString(entry[n:])
+	assert.Contains(t, line, `"message":"hello"`)
+}
+
+func TestLokiHookOutOfOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry with timestamp 2017-07-14 is out of order", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	hook, err := NewLokiHook(LokiConfig{URL: server.URL})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newLokiEntry("rejected", time.Now())))
+	assert.NoError(t, hook.Flush())
+	assert.Equal(t, uint64(0), hook.retry.retries)
+	hook.Close()
+}
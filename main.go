@@ -28,14 +28,47 @@ func init() {
 		SetLevel(log.DebugLevel)
 	}
 	AddHook(logrus_stack.StandardHook())
-	// if Environment == "production" {
-	// 	bugsnag.Configure(bugsnag.Configuration{
-	// 		APIKey: os.Getenv("BUGSNAG_API_KEY"),
-	// 	})
-	// 	hook, err := logrus_bugsnag.NewBugsnagHook()
-	// 	if err != nil {
-	// 		AddHook(hook)
-	// 	}
-	// }
 	replaceGrpcLogger()
 }
+
+// Options configures optional integrations of the standard logger.
+type Options struct {
+	// Bugsnag notifies Bugsnag of error entries when set.
+	Bugsnag *BugsnagConfig
+}
+
+// Integrations are the hooks added to the standard logger by Configure.
+type Integrations struct {
+	Bugsnag *BugsnagHook
+}
+
+// Close sends the last events of the integrations, call it before exiting.
+func (i *Integrations) Close() error {
+	if i.Bugsnag != nil {
+		return i.Bugsnag.Close()
+	}
+	return nil
+}
+
+// Configure enables the integrations set in opts on the standard logger, e.g.
+//
+//	integrations, err := epiclogger.Configure(epiclogger.Options{
+//		Bugsnag: &epiclogger.BugsnagConfig{
+//			APIKey:       os.Getenv("BUGSNAG_API_KEY"),
+//			ReleaseStage: os.Getenv("GO_ENV"),
+//		},
+//	})
+//	...
+//	defer integrations.Close()
+func Configure(opts Options) (*Integrations, error) {
+	integrations := &Integrations{}
+	if opts.Bugsnag != nil {
+		hook, err := NewBugsnagHook(*opts.Bugsnag)
+		if err != nil {
+			return nil, err
+		}
+		AddHook(hook)
+		integrations.Bugsnag = hook
+	}
+	return integrations, nil
+}
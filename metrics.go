@@ -0,0 +1,223 @@
+package epiclogger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsConfig configures a MetricsHook.
+type MetricsConfig struct {
+	// Logger is the value of the logger label, "default" when empty.
+	Logger string
+
+	// Sinks are the hooks and writers of this package whose drops, retries
+	// and queue depth are exported, by sink label.
+	Sinks map[string]interface{}
+}
+
+// MetricsHook counts the entries logged and exports them, with the health
+// of the sinks, in the Prometheus text format.
+type MetricsHook struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	written uint64
+
+	config MetricsConfig
+	sinks  map[string]statsReporter
+
+	mu      sync.Mutex
+	entries map[entryLabels]uint64
+}
+
+type entryLabels struct {
+	level   string
+	service string
+}
+
+// sinkStats are the counters of a sink exported by the MetricsHook.
+type sinkStats struct {
+	dropped uint64
+	retries uint64
+	depth   int
+	breaker string
+}
+
+type statsReporter interface {
+	sinkStats() sinkStats
+}
+
+// NewMetricsHook returns a hook counting entries. Serve it over HTTP to
+// expose the metrics.
+func NewMetricsHook(config MetricsConfig) (*MetricsHook, error) {
+	if config.Logger == "" {
+		config.Logger = "default"
+	}
+	h := &MetricsHook{
+		config:  config,
+		sinks:   map[string]statsReporter{},
+		entries: map[entryLabels]uint64{},
+	}
+	for name, sink := range config.Sinks {
+		reporter, ok := sink.(statsReporter)
+		if !ok {
+			return nil, fmt.Errorf("epiclogger: sink %s (%T) has no metrics", name, sink)
+		}
+		h.sinks[name] = reporter
+	}
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *MetricsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *MetricsHook) Fire(entry *log.Entry) error {
+	labels := entryLabels{level: entry.Level.String()}
+	labels.service, _ = entry.Data["service"].(string)
+	h.mu.Lock()
+	h.entries[labels]++
+	h.mu.Unlock()
+	return nil
+}
+
+// Writer returns w counting the bytes written to it, to be used as the
+// logger's Out.
+func (h *MetricsHook) Writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: &h.written}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
+}
+
+// ServeHTTP implements http.Handler, it writes the metrics.
+func (h *MetricsHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := h.WriteMetrics(w); err != nil {
+		reportError("can't write the metrics: %v", err)
+	}
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format.
+func (h *MetricsHook) WriteMetrics(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	logger := labelPair("logger", h.config.Logger)
+
+	h.mu.Lock()
+	entries := make([]string, 0, len(h.entries))
+	for labels, count := range h.entries {
+		entries = append(entries, fmt.Sprintf("epiclogger_entries_total{%s,%s,%s} %d",
+			logger, labelPair("level", labels.level), labelPair("service", labels.service), count))
+	}
+	h.mu.Unlock()
+	sort.Strings(entries)
+	writeMetric(w, "epiclogger_entries_total", "counter", "Entries logged by level and service.", entries)
+
+	writeMetric(w, "epiclogger_bytes_written_total", "counter", "Bytes written to the logger output.",
+		[]string{fmt.Sprintf("epiclogger_bytes_written_total{%s} %d", logger, atomic.LoadUint64(&h.written))})
+	writeMetric(w, "epiclogger_formatter_failures_total", "counter", "Entries EpicFormatter failed to marshal.",
+		[]string{fmt.Sprintf("epiclogger_formatter_failures_total %d", atomic.LoadUint64(&formatterFailures))})
+
+	names := make([]string, 0, len(h.sinks))
+	for name := range h.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var dropped, retries, depth, breakers []string
+	for _, name := range names {
+		stats := h.sinks[name].sinkStats()
+		sink := labelPair("sink", name)
+		dropped = append(dropped, fmt.Sprintf("epiclogger_sink_dropped_total{%s} %d", sink, stats.dropped))
+		retries = append(retries, fmt.Sprintf("epiclogger_sink_retries_total{%s} %d", sink, stats.retries))
+		depth = append(depth, fmt.Sprintf("epiclogger_sink_queue_depth{%s} %d", sink, stats.depth))
+		if stats.breaker != "" {
+			open := 0
+			if stats.breaker != BreakerClosed {
+				open = 1
+			}
+			breakers = append(breakers, fmt.Sprintf("epiclogger_sink_breaker_open{%s} %d", sink, open))
+		}
+	}
+	writeMetric(w, "epiclogger_sink_dropped_total", "counter", "Entries dropped by the sinks.", dropped)
+	writeMetric(w, "epiclogger_sink_retries_total", "counter", "Retries of the sinks.", retries)
+	writeMetric(w, "epiclogger_sink_queue_depth", "gauge", "Entries waiting in the sink queues.", depth)
+	writeMetric(w, "epiclogger_sink_breaker_open", "gauge", "Whether the circuit breaker of a sink is open.", breakers)
+	return w.Flush()
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, samples []string) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		w.WriteString(sample)
+		w.WriteByte('\n')
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// batchStats returns the counters of a sink built on a batcher.
+func batchStats(b *batcher, r *retryPolicy) sinkStats {
+	return sinkStats{
+		dropped: atomic.LoadUint64(&b.dropped),
+		retries: atomic.LoadUint64(&r.retries),
+		depth:   b.depth(),
+	}
+}
+
+func (h *AlertHook) sinkStats() sinkStats          { return batchStats(h.batcher, h.retry) }
+func (h *BugsnagHook) sinkStats() sinkStats        { return batchStats(h.batcher, h.retry) }
+func (h *CloudLoggingHook) sinkStats() sinkStats   { return batchStats(h.batcher, h.retry) }
+func (h *ElasticsearchHook) sinkStats() sinkStats  { return batchStats(h.batcher, h.retry) }
+func (h *ErrorReportingHook) sinkStats() sinkStats { return batchStats(h.batcher, h.retry) }
+func (h *FluentHook) sinkStats() sinkStats         { return batchStats(h.batcher, h.retry) }
+func (h *LokiHook) sinkStats() sinkStats           { return batchStats(h.batcher, h.retry) }
+func (h *OTLPHook) sinkStats() sinkStats           { return batchStats(h.batcher, h.retry) }
+func (h *SentryHook) sinkStats() sinkStats         { return batchStats(h.batcher, h.retry) }
+func (h *SplunkHook) sinkStats() sinkStats         { return batchStats(h.batcher, h.retry) }
+func (w *SyslogWriter) sinkStats() sinkStats       { return batchStats(w.batcher, w.retry) }
+
+func (f *RotatingFile) sinkStats() sinkStats {
+	return sinkStats{dropped: f.Dropped()}
+}
+
+func (h *GuardedHook) sinkStats() sinkStats {
+	stats := h.Stats()
+	return sinkStats{
+		dropped: stats.Dropped + stats.Rejected,
+		depth:   stats.QueueDepth,
+		breaker: stats.Breaker,
+	}
+}
+
+func (r *Router) sinkStats() sinkStats {
+	var stats sinkStats
+	for _, rt := range r.routes {
+		stats.dropped += atomic.LoadUint64(&rt.batcher.dropped)
+		stats.depth += rt.batcher.depth()
+	}
+	return stats
+}
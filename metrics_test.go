@@ -0,0 +1,48 @@
+package epiclogger
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHook(t *testing.T) {
+	failing := NewGuardedHook(&faultyHook{err: errors.New("down")}, GuardConfig{FailureThreshold: 1, HealthInterval: -1})
+	defer failing.Close()
+	h, err := NewMetricsHook(MetricsConfig{Logger: "api", Sinks: map[string]interface{}{"remote": failing}})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	logger := NewEpicLogger(h.Writer(&out))
+	logger.Logger.Formatter = &EpicFormatter{}
+	logger.Logger.Hooks.Add(h)
+	logger.Logger.Hooks.Add(failing)
+	logger.Info("started")
+	logger.Info("ready")
+	logger.Error("failed")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE epiclogger_entries_total counter",
+		`epiclogger_entries_total{logger="api",level="error",service="golang-service"} 1`,
+		`epiclogger_entries_total{logger="api",level="info",service=""} 2`,
+		"epiclogger_bytes_written_total{logger=\"api\"} " + strconv.Itoa(out.Len()),
+		"# TYPE epiclogger_formatter_failures_total counter",
+		`epiclogger_sink_dropped_total{sink="remote"} 2`,
+		`epiclogger_sink_retries_total{sink="remote"} 0`,
+		`epiclogger_sink_queue_depth{sink="remote"} 0`,
+		`epiclogger_sink_breaker_open{sink="remote"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	_, err = NewMetricsHook(MetricsConfig{Sinks: map[string]interface{}{"stdout": &out}})
+	assert.EqualError(t, err, "epiclogger: sink stdout (*bytes.Buffer) has no metrics")
+}
@@ -0,0 +1,353 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// msgpackEncoder writes the subset of MessagePack needed by the forward
+// protocol. Values it doesn't know are encoded through their JSON form.
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if x {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case string:
+		e.encodeString(x)
+	case []byte:
+		e.encodeBinary(x)
+	case int:
+		e.encodeInt(int64(x))
+	case int8:
+		e.encodeInt(int64(x))
+	case int16:
+		e.encodeInt(int64(x))
+	case int32:
+		e.encodeInt(int64(x))
+	case int64:
+		e.encodeInt(x)
+	case uint:
+		e.encodeUint(uint64(x))
+	case uint8:
+		e.encodeUint(uint64(x))
+	case uint16:
+		e.encodeUint(uint64(x))
+	case uint32:
+		e.encodeUint(uint64(x))
+	case uint64:
+		e.encodeUint(x)
+	case float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = appendUint(e.buf, 4, uint64(math.Float32bits(x)))
+	case float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = appendUint(e.buf, 8, uint64(math.Float64bits(x)))
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			e.encodeInt(i)
+		} else if f, err := x.Float64(); err == nil {
+			e.encode(f)
+		} else {
+			e.encodeString(x.String())
+		}
+	case time.Time:
+		e.encodeEventTime(x)
+	case []interface{}:
+		e.encodeArrayHeader(len(x))
+		for _, item := range x {
+			e.encode(item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.encodeMapHeader(len(x))
+		for _, k := range keys {
+			e.encodeString(k)
+			e.encode(x[k])
+		}
+	case json.RawMessage:
+		e.encodeJSON(x)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			e.encodeString(fmt.Sprint(v))
+			return
+		}
+		e.encodeJSON(b)
+	}
+}
+
+func (e *msgpackEncoder) encodeJSON(b []byte) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		e.encodeString(string(b))
+		return
+	}
+	e.encode(v)
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	if i >= 0 {
+		e.encodeUint(uint64(i))
+		return
+	}
+	switch {
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(i)))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(i)))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint(e.buf, 8, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(i uint64) {
+	switch {
+	case i <= 0x7f:
+		e.buf = append(e.buf, byte(i))
+	case i <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(i))
+	case i <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(i)))
+	case i <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(i)))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint(e.buf, 8, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n <= 31:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(n)))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(n)))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBinary(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(n)))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(n)))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xdc)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(n)))
+	default:
+		e.buf = append(e.buf, 0xdd)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(n)))
+	}
+}
+
+func (e *msgpackEncoder) encodeMapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xde)
+		e.buf = appendUint(e.buf, 2, uint64(uint16(n)))
+	default:
+		e.buf = append(e.buf, 0xdf)
+		e.buf = appendUint(e.buf, 4, uint64(uint32(n)))
+	}
+}
+
+// encodeEventTime writes t as the forward protocol EventTime extension:
+// type 0 holding the seconds and nanoseconds as big endian uint32.
+func (e *msgpackEncoder) encodeEventTime(t time.Time) {
+	e.buf = append(e.buf, 0xd7, 0x00)
+	e.buf = appendUint(e.buf, 4, uint64(uint32(t.Unix())))
+	e.buf = appendUint(e.buf, 4, uint64(uint32(t.Nanosecond())))
+}
+
+var errMsgpackType = errors.New("unsupported MessagePack type")
+
+// msgpackDecoder reads the values written by msgpackEncoder. Maps are
+// decoded as map[string]interface{}, integers as int64 or uint64 and
+// EventTime as time.Time.
+type msgpackDecoder struct {
+	r io.Reader
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	head, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		b, err := d.read(int(c & 0x1f))
+		return string(b), err
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		n, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n))
+		if c >= 0xd9 {
+			return string(b), err
+		}
+		return b, err
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := d.readUint(size)
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xd7:
+		b, err := d.read(9)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != 0 {
+			return nil, errMsgpackType
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(b[1:5])), int64(binary.BigEndian.Uint32(b[5:9]))), nil
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, errMsgpackType
+}
+
+func (d *msgpackDecoder) decodeArray(n int) ([]interface{}, error) {
+	items := make([]interface{}, n)
+	for i := range items {
+		item, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
+
+// appendUint appends the size low bytes of v in big endian order.
+func appendUint(buf []byte, size int, v uint64) []byte {
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(v>>(8*uint(i))))
+	}
+	return buf
+}
@@ -0,0 +1,49 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	values := map[string]interface{}{
+		"nil":      nil,
+		"true":     true,
+		"small":    int64(7),
+		"negative": int64(-100000),
+		"big":      uint64(math.MaxUint64),
+		"float":    1.5,
+		"string":   strings.Repeat("a", 300),
+		"binary":   []byte{1, 2, 3},
+		"time":     time.Unix(1500000000, 42),
+		"array":    []interface{}{int64(1), "two"},
+		"map":      map[string]interface{}{"nested": "value"},
+	}
+	e := &msgpackEncoder{}
+	e.encode(values)
+	decoded, err := (&msgpackDecoder{r: bytes.NewReader(e.buf)}).decode()
+	assert.NoError(t, err)
+	assert.Equal(t, values, decoded)
+}
+
+func TestMsgpackJSONFallback(t *testing.T) {
+	e := &msgpackEncoder{}
+	e.encode(struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}{"jane", 2})
+	e.encode(json.RawMessage(`{"a":[1.5]}`))
+	d := &msgpackDecoder{r: bytes.NewReader(e.buf)}
+	v, err := d.decode()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "jane", "count": int64(2)}, v)
+	v, err = d.decode()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{1.5}}, v)
+}
@@ -0,0 +1,526 @@
+package epiclogger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	logging "google.golang.org/api/logging/v2beta1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultOTLPEndpoint is the OTLP/HTTP endpoint of a local collector.
+const DefaultOTLPEndpoint = "http://localhost:4318"
+
+// OTLPConfig configures an OTLPHook.
+type OTLPConfig struct {
+	// Endpoint is the collector base URL, the logs are sent to
+	// Endpoint/v1/logs. DefaultOTLPEndpoint when empty.
+	Endpoint string
+
+	// JSON sends OTLP/JSON instead of protobuf.
+	JSON bool
+
+	// Header is added to every request, for authentication for instance.
+	Header http.Header
+
+	// ServiceName and ServiceVersion are the service.name and
+	// service.version resource attributes of entries without service or
+	// version field. ResourceAttributes are added to every resource.
+	ServiceName        string
+	ServiceVersion     string
+	ResourceAttributes map[string]string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter collects the fields like the JSON output does.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels exported, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound the export requests.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// exported, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed exports.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// OTLPHook exports entries to an OpenTelemetry collector with OTLP/HTTP,
+// following the OpenTelemetry logs data model.
+type OTLPHook struct {
+	config OTLPConfig
+	url    string
+	retry  *retryPolicy
+	batchSink
+}
+
+// otlpKeyValue is an attribute. Values are string, bool, int64, float64,
+// []byte, []interface{} or []otlpKeyValue.
+type otlpKeyValue struct {
+	key   string
+	value interface{}
+}
+
+type otlpRecord struct {
+	resource       []otlpKeyValue
+	time           time.Time
+	severityNumber int
+	severityText   string
+	body           string
+	attributes     []otlpKeyValue
+	traceID        []byte
+	spanID         []byte
+	flags          uint32
+}
+
+// NewOTLPHook returns a hook exporting entries in the background. Close it
+// before exiting to export the last entries.
+func NewOTLPHook(config OTLPConfig) (*OTLPHook, error) {
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultOTLPEndpoint
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	h := &OTLPHook{
+		config: config,
+		url:    strings.TrimSuffix(config.Endpoint, "/") + "/v1/logs",
+		retry:  newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.start("otlp", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.export)
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *OTLPHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *OTLPHook) Fire(entry *log.Entry) error {
+	record, err := h.record(entry)
+	if err != nil {
+		return err
+	}
+	return h.queue(entry, record, len(record.body))
+}
+
+// otelSeverity maps the levels to the SeverityNumber of the data model.
+func otelSeverity(level log.Level) int {
+	switch level {
+	case log.PanicLevel:
+		return 24 // FATAL4
+	case log.FatalLevel:
+		return 21 // FATAL
+	case log.ErrorLevel:
+		return 17 // ERROR
+	case log.WarnLevel:
+		return 13 // WARN
+	case log.InfoLevel:
+		return 9 // INFO
+	default:
+		return 5 // DEBUG
+	}
+}
+
+// spanContext returns the span of a context passed to WithCtx, or the one
+// of a W3C traceparent in its gRPC metadata.
+func spanContext(entry *log.Entry) trace.SpanContext {
+	for _, v := range entry.Data {
+		ctx, ok := v.(context.Context)
+		if !ok {
+			continue
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			return sc
+		}
+		md, _ := metadata.FromContext(ctx)
+		if values := md["traceparent"]; len(values) > 0 {
+			parts := strings.Split(values[0], "-")
+			if len(parts) != 4 {
+				continue
+			}
+			traceID, err1 := trace.TraceIDFromHex(parts[1])
+			spanID, err2 := trace.SpanIDFromHex(parts[2])
+			flags, err3 := hex.DecodeString(parts[3])
+			if err1 == nil && err2 == nil && err3 == nil && len(flags) == 1 {
+				return trace.NewSpanContext(trace.SpanContextConfig{
+					TraceID:    traceID,
+					SpanID:     spanID,
+					TraceFlags: trace.TraceFlags(flags[0]),
+					Remote:     true,
+				})
+			}
+		}
+	}
+	return trace.SpanContext{}
+}
+
+func (h *OTLPHook) record(entry *log.Entry) (*otlpRecord, error) {
+	data, httpReq, err := h.config.Formatter.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+	record := &otlpRecord{
+		time:           entry.Time,
+		severityNumber: otelSeverity(entry.Level),
+		severityText:   getSeverity(entry.Level),
+		body:           entry.Message,
+	}
+
+	resource := map[string]interface{}{}
+	for k, v := range h.config.ResourceAttributes {
+		resource[k] = v
+	}
+	resource["service.name"] = h.config.ServiceName
+	if h.config.ServiceName == "" {
+		resource["service.name"] = "unknown_service"
+	}
+	if v, ok := data["service"].(string); ok {
+		resource["service.name"] = v
+		delete(data, "service")
+	}
+	if h.config.ServiceVersion != "" {
+		resource["service.version"] = h.config.ServiceVersion
+	}
+	if v, ok := data["version"].(string); ok {
+		resource["service.version"] = v
+		delete(data, "version")
+	}
+	record.resource = otlpAttributes(resource)
+
+	attributes := otelAttributes(data, httpReq)
+	record.attributes = otlpAttributes(attributes)
+
+	if sc := spanContext(entry); sc.IsValid() {
+		traceID, spanID := sc.TraceID(), sc.SpanID()
+		record.traceID = traceID[:]
+		record.spanID = spanID[:]
+		record.flags = uint32(sc.TraceFlags())
+	}
+	return record, nil
+}
+
+// otelAttributes maps the collected fields to attributes, with the
+// semantic convention names for the caller, stack, error and request.
+func otelAttributes(data log.Fields, httpReq *logging.HttpRequest) map[string]interface{} {
+	attributes := map[string]interface{}{}
+	for k, v := range data {
+		switch x := v.(type) {
+		case stack.Frame:
+			attributes["code.filepath"] = x.File
+			attributes["code.lineno"] = x.Line
+			attributes["code.function"] = x.Name
+		case stack.Stack:
+			attributes["exception.stacktrace"] = x.String()
+		default:
+			switch k {
+			case log.ErrorKey:
+				attributes["exception.message"] = v
+			case "stack":
+				attributes["exception.stacktrace"] = v
+			default:
+				attributes[k] = v
+			}
+		}
+	}
+	if httpReq != nil {
+		delete(attributes, "grpc.method")
+		attributes["http.request.method"] = httpReq.RequestMethod
+		attributes["url.full"] = httpReq.RequestUrl
+		if httpReq.Status != 0 {
+			attributes["http.response.status_code"] = httpReq.Status
+		}
+		if httpReq.UserAgent != "" {
+			attributes["user_agent.original"] = httpReq.UserAgent
+		}
+		if httpReq.RemoteIp != "" {
+			attributes["client.address"] = httpReq.RemoteIp
+		}
+	}
+	return attributes
+}
+
+// otlpAttributes returns the attributes in key order.
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		kvs[i] = otlpKeyValue{key: k, value: otlpValue(attributes[k])}
+	}
+	return kvs
+}
+
+// otlpValue converts a normalized field value to an AnyValue.
+func otlpValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string, bool, int64, float64, []byte:
+		return x
+	case int:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case uint32:
+		return int64(x)
+	case float32:
+		return float64(x)
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case fmt.Stringer:
+		return x.String()
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i, item := range x {
+			values[i] = otlpValue(item)
+		}
+		return values
+	case map[string]interface{}:
+		return otlpAttributes(x)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var decoded interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(b)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return string(b)
+	}
+	return otlpValue(decoded)
+}
+
+func (h *OTLPHook) export(items []interface{}) error {
+	records := make([]*otlpRecord, len(items))
+	for i, item := range items {
+		records[i] = item.(*otlpRecord)
+	}
+	header := http.Header{}
+	for k, v := range h.config.Header {
+		header[k] = v
+	}
+	var body []byte
+	if h.config.JSON {
+		header.Set("Content-Type", "application/json")
+		var err error
+		if body, err = json.Marshal(otlpJSONRequest(records)); err != nil {
+			return err
+		}
+	} else {
+		header.Set("Content-Type", "application/x-protobuf")
+		body = encodeOTLPRequest(records)
+	}
+	return h.retry.do(func() error {
+		_, err := post(h.config.Client, h.url, body, header)
+		return err
+	})
+}
+
+// groupByResource returns the records grouped by resource, in order.
+func groupByResource(records []*otlpRecord) [][]*otlpRecord {
+	var groups [][]*otlpRecord
+	index := map[string]int{}
+	for _, r := range records {
+		key := fmt.Sprint(r.resource)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+	return groups
+}
+
+const otlpScopeName = "github.com/andela/epic-logger-go"
+
+// encodeOTLPRequest encodes an ExportLogsServiceRequest.
+func encodeOTLPRequest(records []*otlpRecord) []byte {
+	var req []byte
+	for _, group := range groupByResource(records) {
+		var resource []byte
+		for _, kv := range group[0].resource {
+			resource = appendMessage(resource, 1, appendKeyValue(nil, kv))
+		}
+
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendString(scope, otlpScopeName)
+		var scopeLogs []byte
+		scopeLogs = appendMessage(scopeLogs, 1, scope)
+		for _, r := range group {
+			scopeLogs = appendMessage(scopeLogs, 2, encodeLogRecord(r))
+		}
+
+		var resourceLogs []byte
+		resourceLogs = appendMessage(resourceLogs, 1, resource)
+		resourceLogs = appendMessage(resourceLogs, 2, scopeLogs)
+		req = appendMessage(req, 1, resourceLogs)
+	}
+	return req
+}
+
+func encodeLogRecord(r *otlpRecord) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(r.time.UnixNano()))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.severityNumber))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, r.severityText)
+	b = appendMessage(b, 5, appendAnyValue(nil, r.body))
+	for _, kv := range r.attributes {
+		b = appendMessage(b, 6, appendKeyValue(nil, kv))
+	}
+	if r.traceID != nil {
+		b = protowire.AppendTag(b, 8, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, r.flags)
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.traceID)
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.spanID)
+	}
+	return b
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendKeyValue(b []byte, kv otlpKeyValue) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, kv.key)
+	return appendMessage(b, 2, appendAnyValue(nil, kv.value))
+}
+
+func appendAnyValue(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, x)
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(x))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(x))
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(x))
+	case []interface{}:
+		var array []byte
+		for _, item := range x {
+			array = appendMessage(array, 1, appendAnyValue(nil, item))
+		}
+		b = appendMessage(b, 5, array)
+	case []otlpKeyValue:
+		var list []byte
+		for _, kv := range x {
+			list = appendMessage(list, 1, appendKeyValue(nil, kv))
+		}
+		b = appendMessage(b, 6, list)
+	case []byte:
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, x)
+	}
+	return b
+}
+
+// otlpJSONRequest returns the OTLP/JSON form of the request: camelCase
+// names, 64 bit integers as strings and ids in hex.
+func otlpJSONRequest(records []*otlpRecord) map[string]interface{} {
+	var resourceLogs []interface{}
+	for _, group := range groupByResource(records) {
+		logRecords := make([]interface{}, len(group))
+		for i, r := range group {
+			record := map[string]interface{}{
+				"timeUnixNano":   strconv.FormatInt(r.time.UnixNano(), 10),
+				"severityNumber": r.severityNumber,
+				"severityText":   r.severityText,
+				"body":           jsonAnyValue(r.body),
+				"attributes":     jsonKeyValues(r.attributes),
+			}
+			if r.traceID != nil {
+				record["traceId"] = hex.EncodeToString(r.traceID)
+				record["spanId"] = hex.EncodeToString(r.spanID)
+				record["flags"] = r.flags
+			}
+			logRecords[i] = record
+		}
+		resourceLogs = append(resourceLogs, map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": jsonKeyValues(group[0].resource)},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": otlpScopeName},
+				"logRecords": logRecords,
+			}},
+		})
+	}
+	return map[string]interface{}{"resourceLogs": resourceLogs}
+}
+
+func jsonKeyValues(kvs []otlpKeyValue) []interface{} {
+	values := make([]interface{}, len(kvs))
+	for i, kv := range kvs {
+		values[i] = map[string]interface{}{"key": kv.key, "value": jsonAnyValue(kv.value)}
+	}
+	return values
+}
+
+func jsonAnyValue(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": x}
+	case bool:
+		return map[string]interface{}{"boolValue": x}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": x}
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i, item := range x {
+			values[i] = jsonAnyValue(item)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case []otlpKeyValue:
+		return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": jsonKeyValues(x)}}
+	case []byte:
+		return map[string]interface{}{"bytesValue": x}
+	}
+	return map[string]interface{}{}
+}
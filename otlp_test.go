@@ -0,0 +1,132 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// collectorStub records the bodies of the requests to /v1/logs.
+func collectorStub(t *testing.T, contentType string) (*httptest.Server, chan []byte) {
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		assert.Equal(t, contentType, r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	return server, bodies
+}
+
+func newOTLPEntry() *logrus.Entry {
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	entry := logrus.WithFields(logrus.Fields{
+		"ctx":     ctx,
+		"service": "checkout",
+		"version": "2.0",
+		"error":   errors.New("card declined"),
+		"amount":  12,
+	})
+	entry.Level = logrus.WarnLevel
+	entry.Time = time.Unix(1500000000, 0)
+	entry.Message = "payment failed"
+	return entry
+}
+
+func TestOTLPHookJSON(t *testing.T) {
+	server, bodies := collectorStub(t, "application/json")
+	defer server.Close()
+
+	hook, err := NewOTLPHook(OTLPConfig{Endpoint: server.URL, JSON: true, ResourceAttributes: map[string]string{"deployment.environment": "test"}})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newOTLPEntry()))
+	assert.NoError(t, hook.Close())
+
+	var req struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []map[string]interface{} `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				LogRecords []map[string]interface{} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	assert.NoError(t, json.Unmarshal(<-bodies, &req))
+	assert.Equal(t, []map[string]interface{}{
+		{"key": "deployment.environment", "value": map[string]interface{}{"stringValue": "test"}},
+		{"key": "service.name", "value": map[string]interface{}{"stringValue": "checkout"}},
+		{"key": "service.version", "value": map[string]interface{}{"stringValue": "2.0"}},
+	}, req.ResourceLogs[0].Resource.Attributes)
+
+	record := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	assert.Equal(t, "1500000000000000000", record["timeUnixNano"])
+	assert.Equal(t, float64(13), record["severityNumber"])
+	assert.Equal(t, "WARNING", record["severityText"])
+	assert.Equal(t, map[string]interface{}{"stringValue": "payment failed"}, record["body"])
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", record["traceId"])
+	assert.Equal(t, "b7ad6b7169203331", record["spanId"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "amount", "value": map[string]interface{}{"intValue": "12"}},
+		map[string]interface{}{"key": "exception.message", "value": map[string]interface{}{"stringValue": "card declined"}},
+	}, record["attributes"])
+}
+
+func TestOTLPHookProtobuf(t *testing.T) {
+	server, bodies := collectorStub(t, "application/x-protobuf")
+	defer server.Close()
+
+	hook, err := NewOTLPHook(OTLPConfig{Endpoint: server.URL})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newOTLPEntry()))
+	assert.NoError(t, hook.Close())
+
+	// resourceLogs[0].scopeLogs[0].logRecords[0]
+	field := func(b []byte, want protowire.Number) []byte {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			b = b[n:]
+			if typ == protowire.BytesType {
+				v, n := protowire.ConsumeBytes(b)
+				if num == want {
+					return v
+				}
+				b = b[n:]
+				continue
+			}
+			b = b[protowire.ConsumeFieldValue(num, typ, b):]
+		}
+		return nil
+	}
+	record := field(field(field(<-bodies, 1), 2), 2)
+	assert.Equal(t, "WARNING", string(field(record, 3)))
+	assert.Equal(t, "payment failed", string(field(field(record, 5), 1)))
+	assert.Equal(t, []byte{0x0a, 0xf7, 0x65, 0x19, 0x16, 0xcd, 0x43, 0xdd, 0x84, 0x48, 0xeb, 0x21, 0x1c, 0x80, 0x31, 0x9c}, field(record, 9))
+}
+
+func TestOTLPTraceparent(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	))
+	sc := spanContext(logrus.WithField("ctx", ctx))
+	assert.True(t, sc.IsValid())
+	assert.Equal(t, "b7ad6b7169203331", sc.SpanID().String())
+	assert.True(t, sc.IsSampled())
+}
@@ -0,0 +1,403 @@
+package epiclogger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of the rotated files.
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFileConfig configures a RotatingFile.
+type RotatingFileConfig struct {
+	// Filename is the file written to. Rotated files are kept next to it,
+	// named after it with the rotation time before the extension.
+	Filename string
+
+	// MaxSize rotates the file before it grows over MaxSize bytes.
+	MaxSize int64
+
+	// RotateEvery rotates the file at every multiple of RotateEvery since
+	// the zero time, every UTC midnight for 24 * time.Hour.
+	RotateEvery time.Duration
+
+	// Compress is CompressNone, CompressGzip or CompressZstd. Rotated
+	// files are compressed in the background.
+	Compress string
+
+	// MaxAge removes the rotated files older than MaxAge, MaxBackups
+	// keeps only the MaxBackups most recent ones. Zero keeps them all.
+	MaxAge     time.Duration
+	MaxBackups int
+
+	// FileMode of the created files, 0644 when zero.
+	FileMode os.FileMode
+
+	// ReopenOnSIGHUP reopens Filename when the process receives SIGHUP,
+	// after an external logrotate moved it.
+	ReopenOnSIGHUP bool
+}
+
+// RotatingFile is an io.WriteCloser for the logger's Out that rotates,
+// compresses and removes old log files. It is safe for concurrent use.
+// Write errors, a full disk for instance, drop the entries instead of
+// failing the logger; they are reported on stderr and counted by Dropped.
+type RotatingFile struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	dropped uint64
+
+	config RotatingFileConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	period   time.Time
+	failing  bool
+	closed   bool
+	mill     chan struct{}
+	millDone chan struct{}
+	signals  chan os.Signal
+}
+
+// NewRotatingFile opens config.Filename for appending, creating it and its
+// directory when needed.
+func NewRotatingFile(config RotatingFileConfig) (*RotatingFile, error) {
+	if config.Filename == "" {
+		return nil, fmt.Errorf("epiclogger: a Filename is required")
+	}
+	switch config.Compress {
+	case CompressNone, CompressGzip, CompressZstd:
+	default:
+		return nil, fmt.Errorf("epiclogger: unsupported compression %q", config.Compress)
+	}
+	if config.FileMode == 0 {
+		config.FileMode = 0644
+	}
+	f := &RotatingFile{
+		config:   config,
+		mill:     make(chan struct{}, 1),
+		millDone: make(chan struct{}),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.runMill()
+	if config.ReopenOnSIGHUP {
+		f.signals = make(chan os.Signal, 1)
+		signal.Notify(f.signals, syscall.SIGHUP)
+		go func() {
+			for range f.signals {
+				if err := f.Reopen(); err != nil {
+					reportError("can't reopen %s: %v", config.Filename, err)
+				}
+			}
+		}()
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.config.Filename), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.config.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.config.FileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.period = f.currentPeriod()
+	return nil
+}
+
+func (f *RotatingFile) currentPeriod() time.Time {
+	if f.config.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Truncate(f.config.RotateEvery)
+}
+
+// Write implements io.Writer. p is never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.write(p)
+	if err != nil {
+		atomic.AddUint64(&f.dropped, 1)
+		if !f.failing {
+			reportError("dropping entries, can't write to %s: %v", f.config.Filename, err)
+			f.failing = true
+		}
+	} else if f.failing {
+		reportError("writing to %s again, %d entries dropped so far", f.config.Filename, atomic.LoadUint64(&f.dropped))
+		f.failing = false
+	}
+	return len(p), nil
+}
+
+func (f *RotatingFile) write(p []byte) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	tooBig := f.config.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.config.MaxSize
+	if tooBig || !f.currentPeriod().Equal(f.period) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+// Rotate closes the current file, moves it aside and opens a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if _, err := os.Stat(f.config.Filename); err == nil {
+		if err := os.Rename(f.config.Filename, f.backupName()); err != nil {
+			return err
+		}
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.closed {
+		return nil
+	}
+	select {
+	case f.mill <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Reopen closes and reopens Filename, for when it was moved by another
+// program.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Sync commits the file to the disk. It fails when the last write failed,
+// since Write doesn't report errors.
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return fmt.Errorf("epiclogger: writes to %s are failing", f.config.Filename)
+	}
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.file.Sync()
+}
+
+// Dropped returns the number of writes that failed.
+func (f *RotatingFile) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// Close closes the file and waits for the compression of the rotated files.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.signals != nil {
+		signal.Stop(f.signals)
+		close(f.signals)
+	}
+	close(f.mill)
+	<-f.millDone
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) prefixAndExt() (string, string) {
+	name := filepath.Base(f.config.Filename)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-", ext
+}
+
+// backupName returns an unused name for the file rotated now.
+func (f *RotatingFile) backupName() string {
+	prefix, ext := f.prefixAndExt()
+	dir := filepath.Dir(f.config.Filename)
+	t := time.Now().UTC()
+	for {
+		name := filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+		if !fileExists(name) && !fileExists(name+".gz") && !fileExists(name+".zst") {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+type backupFile struct {
+	path string
+	time time.Time
+}
+
+// backups returns the rotated files, most recent first.
+func (f *RotatingFile) backups() []backupFile {
+	dir := filepath.Dir(f.config.Filename)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	prefix, ext := f.prefixAndExt()
+	var backups []backupFile
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		for _, suffix := range []string{".gz", ".zst"} {
+			stamp = strings.TrimSuffix(stamp, suffix)
+		}
+		t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups
+}
+
+// runMill compresses and removes the rotated files after each rotation.
+func (f *RotatingFile) runMill() {
+	defer close(f.millDone)
+	for range f.mill {
+		f.compressBackups()
+		f.removeBackups()
+	}
+}
+
+func (f *RotatingFile) compressBackups() {
+	if f.config.Compress == CompressNone {
+		return
+	}
+	for _, backup := range f.backups() {
+		if strings.HasSuffix(backup.path, ".gz") || strings.HasSuffix(backup.path, ".zst") {
+			continue
+		}
+		if err := compressFile(backup.path, f.config.Compress, f.config.FileMode); err != nil {
+			// the uncompressed file is kept, on a full disk for instance
+			reportError("can't compress %s: %v", backup.path, err)
+		}
+	}
+}
+
+func (f *RotatingFile) removeBackups() {
+	for i, backup := range f.backups() {
+		tooMany := f.config.MaxBackups > 0 && i >= f.config.MaxBackups
+		tooOld := f.config.MaxAge > 0 && time.Since(backup.time) > f.config.MaxAge
+		if tooMany || tooOld {
+			os.Remove(backup.path)
+		}
+	}
+}
+
+func compressFile(path, algorithm string, mode os.FileMode) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	target := path + ".gz"
+	if algorithm == CompressZstd {
+		target = path + ".zst"
+	}
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(target)
+		} else {
+			os.Remove(path)
+		}
+	}()
+
+	var w io.WriteCloser
+	if algorithm == CompressZstd {
+		if w, err = zstd.NewWriter(dst); err != nil {
+			return err
+		}
+	} else {
+		w = gzip.NewWriter(dst)
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,196 @@
+package epiclogger
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func rotatedFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		if file.Name() != "app.log" {
+			names = append(names, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewRotatingFile(RotatingFileConfig{Filename: filepath.Join(dir, "app.log"), MaxSize: 10})
+	assert.NoError(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		n, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, f.Close())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "third\n", string(b))
+	files := rotatedFiles(t, dir)
+	if assert.Len(t, files, 2) {
+		b, _ = ioutil.ReadFile(files[0])
+		assert.Equal(t, "first\n", string(b))
+		b, _ = ioutil.ReadFile(files[1])
+		assert.Equal(t, "second\n", string(b))
+		assert.True(t, strings.HasPrefix(filepath.Base(files[0]), "app-"))
+		assert.True(t, strings.HasSuffix(files[0], ".log"))
+	}
+}
+
+func TestRotatingFileCompressionAndRetention(t *testing.T) {
+	for _, algorithm := range []string{CompressGzip, CompressZstd} {
+		dir, err := ioutil.TempDir("", "rotating")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		f, err := NewRotatingFile(RotatingFileConfig{
+			Filename:   filepath.Join(dir, "app.log"),
+			Compress:   algorithm,
+			MaxBackups: 2,
+		})
+		assert.NoError(t, err)
+		for _, line := range []string{"one\n", "two\n", "three\n"} {
+			f.Write([]byte(line))
+			assert.NoError(t, f.Rotate())
+		}
+		f.Write([]byte("four\n"))
+		assert.NoError(t, f.Close())
+
+		files := rotatedFiles(t, dir)
+		if !assert.Len(t, files, 2, algorithm) {
+			continue
+		}
+		file, err := os.Open(files[1])
+		assert.NoError(t, err)
+		var content []byte
+		if algorithm == CompressGzip {
+			assert.True(t, strings.HasSuffix(files[1], ".log.gz"))
+			r, err := gzip.NewReader(file)
+			assert.NoError(t, err)
+			content, err = ioutil.ReadAll(r)
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, strings.HasSuffix(files[1], ".log.zst"))
+			r, err := zstd.NewReader(file)
+			assert.NoError(t, err)
+			content, err = ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			r.Close()
+		}
+		file.Close()
+		assert.Equal(t, "three\n", string(content))
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "app-"+time.Now().Add(-48*time.Hour).UTC().Format(backupTimeFormat)+".log.gz")
+	other := filepath.Join(dir, "other.log")
+	for _, name := range []string{old, other} {
+		assert.NoError(t, ioutil.WriteFile(name, []byte("x"), 0644))
+	}
+
+	f, err := NewRotatingFile(RotatingFileConfig{Filename: filepath.Join(dir, "app.log"), MaxAge: 24 * time.Hour})
+	assert.NoError(t, err)
+	f.Write([]byte("line\n"))
+	assert.NoError(t, f.Rotate())
+	assert.NoError(t, f.Close())
+
+	files := rotatedFiles(t, dir)
+	if assert.Len(t, files, 2) {
+		assert.NotEqual(t, old, files[0])
+		assert.Equal(t, other, files[1])
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "app.log")
+	f, err := NewRotatingFile(RotatingFileConfig{Filename: name})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+	// what logrotate does before sending SIGHUP
+	assert.NoError(t, os.Rename(name, name+".1"))
+	f.Write([]byte("moved\n"))
+	assert.NoError(t, f.Reopen())
+	f.Write([]byte("after\n"))
+
+	b, _ := ioutil.ReadFile(name + ".1")
+	assert.Equal(t, "before\nmoved\n", string(b))
+	b, _ = ioutil.ReadFile(name)
+	assert.Equal(t, "after\n", string(b))
+}
+
+func TestRotatingFileConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewRotatingFile(RotatingFileConfig{Filename: filepath.Join(dir, "app.log"), MaxSize: 100})
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				f.Write([]byte("0123456789\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, f.Close())
+
+	var total int
+	for _, name := range append(rotatedFiles(t, dir), filepath.Join(dir, "app.log")) {
+		b, err := ioutil.ReadFile(name)
+		assert.NoError(t, err)
+		assert.True(t, len(b) <= 100)
+		assert.Equal(t, 0, len(b)%11)
+		total += len(b)
+	}
+	assert.Equal(t, 8*50*11, total)
+}
+
+func TestRotatingFileDiskFull(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	f, err := NewRotatingFile(RotatingFileConfig{Filename: "/dev/full"})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		n, err := f.Write([]byte("lost\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+	}
+	assert.Equal(t, uint64(3), f.Dropped())
+}
@@ -0,0 +1,258 @@
+package epiclogger
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRouteQueueSize is the number of entries a route keeps while its
+// sink is busy.
+const DefaultRouteQueueSize = 1000
+
+// Route sends the entries matching its filters to a sink, either a Writer
+// with its Formatter or a Hook.
+type Route struct {
+	// Name identifies the route in errors.
+	Name string
+
+	// Writer receives the entries formatted with Formatter, an EpicFormatter
+	// when nil.
+	Writer    io.Writer
+	Formatter log.Formatter
+
+	// Hook is fired with the entries, for the levels it supports. It is
+	// used instead of Writer when set.
+	Hook log.Hook
+
+	// LogLevels are the levels routed, all of them when nil. Use LevelsFrom
+	// for a minimum level.
+	LogLevels []log.Level
+
+	// Match routes only the entries with these fields, compared by their
+	// printed values so that "true" matches true.
+	Match map[string]interface{}
+
+	// Filter routes only the entries it returns true for.
+	Filter func(entry *log.Entry) bool
+
+	// QueueSize is the number of entries kept while the sink is busy,
+	// DefaultRouteQueueSize when zero. Entries are dropped once it is full,
+	// so that a slow sink doesn't slow down the others or the logger. The
+	// drops are counted and reported on stderr every minute.
+	QueueSize int
+}
+
+// LevelsFrom returns level and the levels more severe than it.
+func LevelsFrom(level log.Level) []log.Level {
+	var levels []log.Level
+	for _, l := range log.AllLevels {
+		if l <= level {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+type route struct {
+	Route
+	levels map[log.Level]bool
+	batchSink
+}
+
+// Router is a hook fanning out the entries to several routes. Each route
+// has its own queue and goroutine.
+type Router struct {
+	routes []*route
+}
+
+// NewRouter returns a router sending the entries to routes.
+func NewRouter(routes ...Route) (*Router, error) {
+	r := &Router{}
+	for i, config := range routes {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("route %d", i)
+		}
+		if config.Writer == nil && config.Hook == nil {
+			return nil, fmt.Errorf("epiclogger: %s has neither a Writer nor a Hook", config.Name)
+		}
+		if config.Formatter == nil {
+			config.Formatter = &EpicFormatter{}
+		}
+		levels := config.LogLevels
+		if levels == nil {
+			levels = log.AllLevels
+		}
+		rt := &route{Route: config, levels: map[log.Level]bool{}}
+		for _, level := range levels {
+			rt.levels[level] = true
+		}
+		if config.Hook != nil {
+			hookLevels := map[log.Level]bool{}
+			for _, level := range config.Hook.Levels() {
+				hookLevels[level] = true
+			}
+			for level := range rt.levels {
+				rt.levels[level] = hookLevels[level]
+			}
+		}
+		rt.start(config.Name, newBatchOptions(1, 0, 0, limit(config.QueueSize, DefaultRouteQueueSize)), rt.send)
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// NewRoutedEpicLogger returns a logger whose entries only go through router.
+func NewRoutedEpicLogger(router *Router) EpicLogger {
+	l := log.New()
+	routeLogger(l, router)
+	return EpicLogger{Entry: log.NewEntry(l)}
+}
+
+// UseRouter sends the entries of the standard logger through router only.
+func UseRouter(router *Router) {
+	routeLogger(baseLogger.Logger, router)
+}
+
+func routeLogger(l *log.Logger, router *Router) {
+	l.Out = ioutil.Discard
+	l.Formatter = discardFormatter{}
+	// the routes have their own levels
+	l.SetLevel(log.DebugLevel)
+	l.Hooks.Add(router)
+}
+
+// discardFormatter skips the formatting of entries written to nowhere.
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// Levels implements logrus.Hook.
+func (r *Router) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook. Entries dropped because a route queue is full
+// aren't reported as errors, they are counted and reported periodically.
+func (r *Router) Fire(entry *log.Entry) error {
+	var err error
+	var routed []*route
+	for _, rt := range r.routes {
+		if !rt.matches(entry) {
+			continue
+		}
+		if !rt.add(copyEntry(entry), 1) {
+			continue
+		}
+		routed = append(routed, rt)
+	}
+	// logrus exits or panics right after firing the hooks
+	if entry.Level <= log.FatalLevel {
+		for _, rt := range routed {
+			if flushErr := rt.flush(); flushErr != nil {
+				err = flushErr
+			}
+		}
+	}
+	return err
+}
+
+// copyEntry copies entry to be used after it is logged: the hooks fired
+// after this one may still change the fields, and logrus reuses its buffer
+// once the entry is written.
+func copyEntry(entry *log.Entry) *log.Entry {
+	copied := *entry
+	copied.Buffer = nil
+	copied.Data = make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		copied.Data[k] = v
+	}
+	return &copied
+}
+
+// Flush waits for the routed entries to be handed to the sinks, and flushes
+// the sinks that support it.
+func (r *Router) Flush() error {
+	var err error
+	for _, rt := range r.routes {
+		if flushErr := rt.flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Close flushes the routes and closes the sinks that support it, except
+// stdout and stderr.
+func (r *Router) Close() error {
+	var err error
+	for _, rt := range r.routes {
+		rt.batchSink.Close()
+		if rt.Writer == os.Stdout || rt.Writer == os.Stderr {
+			continue
+		}
+		if closer, ok := rt.sink().(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func (rt *route) sink() interface{} {
+	if rt.Hook != nil {
+		return rt.Hook
+	}
+	return rt.Writer
+}
+
+func (rt *route) matches(entry *log.Entry) bool {
+	if !rt.levels[entry.Level] {
+		return false
+	}
+	for k, want := range rt.Match {
+		v, ok := entry.Data[k]
+		if !ok || fmt.Sprint(v) != fmt.Sprint(want) {
+			return false
+		}
+	}
+	return rt.Filter == nil || rt.Filter(entry)
+}
+
+func (rt *route) send(items []interface{}) error {
+	var lastErr error
+	for _, item := range items {
+		entry := item.(*log.Entry)
+		var err error
+		if rt.Hook != nil {
+			err = rt.Hook.Fire(entry)
+		} else {
+			var b []byte
+			if b, err = rt.Formatter.Format(entry); err == nil {
+				_, err = rt.Writer.Write(b)
+			}
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", rt.Name, err)
+		}
+	}
+	return lastErr
+}
+
+func (rt *route) flush() error {
+	err := rt.batcher.flush()
+	if flusher, ok := rt.sink().(interface {
+		Flush() error
+	}); ok {
+		if flushErr := flusher.Flush(); flushErr != nil {
+			err = fmt.Errorf("%s: %v", rt.Name, flushErr)
+		}
+	}
+	return err
+}
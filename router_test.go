@@ -0,0 +1,76 @@
+package epiclogger
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	var stdout, audit bytes.Buffer
+	errorHook := &recordingHook{}
+	router, err := NewRouter(
+		Route{Name: "stdout", Writer: &stdout},
+		Route{Name: "errors", Hook: errorHook, LogLevels: LevelsFrom(logrus.ErrorLevel)},
+		Route{Name: "audit", Writer: &audit, Formatter: &logrus.TextFormatter{DisableTimestamp: true}, Match: map[string]interface{}{"audit": "true"}},
+	)
+	assert.NoError(t, err)
+	logger := NewRoutedEpicLogger(router)
+
+	logger.Debug("starting")
+	logger.WithField("audit", true).Info("user deleted")
+	logger.Error("failed")
+	assert.NoError(t, router.Flush())
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `"message":"starting"`)
+		assert.Contains(t, lines[2], `"message":"failed"`)
+	}
+	if assert.Len(t, errorHook.entries, 1) {
+		assert.Equal(t, "failed", errorHook.entries[0].Message)
+	}
+	assert.Equal(t, "level=info msg=\"user deleted\" audit=true\n", audit.String())
+	assert.NoError(t, router.Close())
+
+	_, err = NewRouter(Route{Name: "nowhere"})
+	assert.EqualError(t, err, "epiclogger: nowhere has neither a Writer nor a Hook")
+}
+
+// blockedWriter blocks until released.
+type blockedWriter struct {
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestRouterSlowSink(t *testing.T) {
+	slow := &blockedWriter{release: make(chan struct{})}
+	var fast bytes.Buffer
+	router, err := NewRouter(
+		Route{Name: "slow", Writer: slow, QueueSize: 1},
+		Route{Name: "fast", Writer: &fast},
+	)
+	assert.NoError(t, err)
+
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.InfoLevel
+	for i := 0; i < 10; i++ {
+		entry.Message = "tick"
+		assert.NoError(t, router.Fire(entry))
+	}
+	assert.True(t, atomic.LoadUint64(&router.routes[0].drops.dropped) > 0)
+	assert.Zero(t, atomic.LoadUint64(&router.routes[1].drops.dropped))
+
+	router.routes[1].flush()
+	assert.Equal(t, 10, strings.Count(fast.String(), `"message":"tick"`))
+	close(slow.release)
+	assert.NoError(t, router.Close())
+}
@@ -0,0 +1,384 @@
+package epiclogger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stack"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// DefaultMaxBreadcrumbs is the default number of breadcrumbs sent with an event.
+const DefaultMaxBreadcrumbs = 20
+
+// maxBreadcrumbContexts bounds the number of contexts breadcrumbs are kept for.
+const maxBreadcrumbContexts = 1000
+
+// SentryConfig configures a SentryHook.
+type SentryConfig struct {
+	// DSN is the project DSN, e.g. https://public@sentry.example.com/42
+	DSN string
+
+	// Environment and Release are sent with every event.
+	Environment string
+	Release     string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// LogLevels are the levels sent as events, error and above when nil.
+	// Entries at the other levels logged with WithCtx become breadcrumbs
+	// of the events logged with the same context.
+	LogLevels []log.Level
+
+	// MaxBreadcrumbs is the number of breadcrumbs kept per context,
+	// DefaultMaxBreadcrumbs when zero.
+	MaxBreadcrumbs int
+
+	// QueueSize is the number of events kept in memory while waiting to be
+	// sent, new events are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed events.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// SentryHook sends error entries to Sentry with the envelope protocol.
+type SentryHook struct {
+	config      SentryConfig
+	levels      map[log.Level]bool
+	envelopeURL string
+	auth        string
+	retry       *retryPolicy
+	batchSink
+
+	mu          sync.Mutex
+	breadcrumbs map[interface{}][]sentryBreadcrumb
+	contexts    []interface{}
+}
+
+// NewSentryHook returns a hook sending error entries to the Sentry project
+// of config.DSN in the background. Close it before exiting to send the last
+// events.
+func NewSentryHook(config SentryConfig) (*SentryHook, error) {
+	dsn, err := url.Parse(config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("epiclogger: invalid Sentry DSN: %v", err)
+	}
+	idx := strings.LastIndex(dsn.Path, "/")
+	if dsn.User == nil || idx < 0 || dsn.Path[idx+1:] == "" {
+		return nil, fmt.Errorf("epiclogger: invalid Sentry DSN %q", config.DSN)
+	}
+	projectID := dsn.Path[idx+1:]
+	if config.LogLevels == nil {
+		config.LogLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+	}
+	if config.MaxBreadcrumbs == 0 {
+		config.MaxBreadcrumbs = DefaultMaxBreadcrumbs
+	}
+
+	h := &SentryHook{
+		config:      config,
+		levels:      map[log.Level]bool{},
+		envelopeURL: fmt.Sprintf("%s://%s%s/api/%s/envelope/", dsn.Scheme, dsn.Host, dsn.Path[:idx], projectID),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=epic-logger-go/1.0, sentry_key=%s", dsn.User.Username()),
+		retry:       newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+		breadcrumbs: map[interface{}][]sentryBreadcrumb{},
+	}
+	for _, level := range config.LogLevels {
+		h.levels[level] = true
+	}
+	h.start("sentry", newBatchOptions(0, 0, time.Second, config.QueueSize), h.send)
+	return h, nil
+}
+
+// Levels implements logrus.Hook. All levels are needed for the breadcrumbs.
+func (h *SentryHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *SentryHook) Fire(entry *log.Entry) error {
+	ctx, key := sentryContext(entry)
+	if !h.levels[entry.Level] {
+		if key != nil {
+			h.addBreadcrumb(key, entry)
+		}
+		return nil
+	}
+
+	event := h.event(entry, ctx)
+	if key != nil {
+		event.Breadcrumbs = h.breadcrumbsFor(key)
+	}
+	return h.queue(entry, event, 0)
+}
+
+type sentryEvent struct {
+	EventID     string             `json:"event_id"`
+	Timestamp   string             `json:"timestamp"`
+	Level       string             `json:"level"`
+	Platform    string             `json:"platform"`
+	Logger      string             `json:"logger"`
+	ServerName  string             `json:"server_name,omitempty"`
+	Environment string             `json:"environment,omitempty"`
+	Release     string             `json:"release,omitempty"`
+	Message     map[string]string  `json:"message"`
+	Exception   *sentryExceptions  `json:"exception,omitempty"`
+	User        map[string]string  `json:"user,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	Extra       log.Fields         `json:"extra,omitempty"`
+	Breadcrumbs []sentryBreadcrumb `json:"breadcrumbs,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Filename string `json:"filename"`
+	Function string `json:"function"`
+	Lineno   int    `json:"lineno"`
+}
+
+type sentryBreadcrumb struct {
+	Timestamp string     `json:"timestamp"`
+	Level     string     `json:"level"`
+	Category  string     `json:"category"`
+	Message   string     `json:"message"`
+	Data      log.Fields `json:"data,omitempty"`
+}
+
+func sentryLevel(level log.Level) string {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return "fatal"
+	case log.WarnLevel:
+		return "warning"
+	default:
+		return level.String()
+	}
+}
+
+// sentryContext returns the context the entry was logged with, and the key
+// its breadcrumbs are kept under: the correlation id when there is one, the
+// context itself otherwise.
+func sentryContext(entry *log.Entry) (context.Context, interface{}) {
+	for _, v := range entry.Data {
+		ctx, ok := v.(context.Context)
+		if !ok {
+			continue
+		}
+		extracted, fieldMap := contextFields(ctx, entry.Logger.Formatter)
+		if id, ok := extracted[fieldMap.resolve(FieldKeyCorrelationID)]; ok {
+			return ctx, fmt.Sprint(id)
+		}
+		// an EpicLogger with its own extractors wraps the context every
+		// time it is logged
+		key := ctx
+		if lc, ok := ctx.(*loggerContext); ok {
+			key = lc.Context
+		}
+		// contexts are compared by identity, which needs a comparable type
+		if reflect.TypeOf(key).Comparable() {
+			return ctx, key
+		}
+		return ctx, nil
+	}
+	return nil, nil
+}
+
+func (h *SentryHook) addBreadcrumb(key interface{}, entry *log.Entry) {
+	crumb := sentryBreadcrumb{
+		Timestamp: entry.Time.UTC().Format(time.RFC3339Nano),
+		Level:     sentryLevel(entry.Level),
+		Category:  "log",
+		Message:   entry.Message,
+		Data:      sentryFields(entry),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	crumbs, ok := h.breadcrumbs[key]
+	if !ok {
+		h.contexts = append(h.contexts, key)
+		if len(h.contexts) > maxBreadcrumbContexts {
+			delete(h.breadcrumbs, h.contexts[0])
+			h.contexts = h.contexts[1:]
+		}
+	}
+	crumbs = append(crumbs, crumb)
+	if len(crumbs) > h.config.MaxBreadcrumbs {
+		crumbs = crumbs[len(crumbs)-h.config.MaxBreadcrumbs:]
+	}
+	h.breadcrumbs[key] = crumbs
+}
+
+func (h *SentryHook) breadcrumbsFor(key interface{}) []sentryBreadcrumb {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]sentryBreadcrumb(nil), h.breadcrumbs[key]...)
+}
+
+// sentryFields returns the plain fields of entry, leaving out the ones that
+// are mapped to dedicated parts of the event.
+func sentryFields(entry *log.Entry) log.Fields {
+	fields := log.Fields{}
+	for k, v := range entry.Data {
+		switch v.(type) {
+		case error, context.Context, stack.Frame, stack.Stack:
+			continue
+		}
+		fields[k] = defaultFieldEncoder.Encode(v)
+	}
+	return fields
+}
+
+func (h *SentryHook) event(entry *log.Entry, ctx context.Context) *sentryEvent {
+	event := &sentryEvent{
+		EventID:     newEventID(),
+		Timestamp:   entry.Time.UTC().Format(time.RFC3339Nano),
+		Level:       sentryLevel(entry.Level),
+		Platform:    "go",
+		Logger:      "epiclogger",
+		Environment: h.config.Environment,
+		Release:     h.config.Release,
+		Message:     map[string]string{"formatted": entry.Message},
+		Tags:        map[string]string{},
+		Extra:       sentryFields(entry),
+	}
+	for _, k := range []string{"service", "version"} {
+		if v, ok := entry.Data[k].(string); ok {
+			event.Tags[k] = v
+		}
+	}
+	if ctx != nil {
+		extracted, fieldMap := contextFields(ctx, entry.Logger.Formatter)
+		user := map[string]string{}
+		if id, ok := extracted[fieldMap.resolve(FieldKeyUserID)]; ok {
+			user["id"] = fmt.Sprint(id)
+		}
+		if name, ok := extracted["user"]; ok {
+			user["username"] = fmt.Sprint(name)
+		}
+		if len(user) > 0 {
+			event.User = user
+		}
+		if id, ok := extracted[fieldMap.resolve(FieldKeyCorrelationID)]; ok {
+			event.Tags["correlation_id"] = fmt.Sprint(id)
+		}
+	}
+
+	var exceptions []sentryException
+	if err, ok := entry.Data[log.ErrorKey].(error); ok {
+		exceptions = errorChain(err)
+	} else {
+		exceptions = []sentryException{{Type: entry.Level.String(), Value: entry.Message}}
+	}
+	var frames []sentryFrame
+	if st, ok := entry.Data["stack"].(stack.Stack); ok {
+		// Sentry wants the outermost frame first
+		for i := len(st) - 1; i >= 0; i-- {
+			frames = append(frames, sentryFrame{Filename: st[i].File, Function: st[i].Name, Lineno: st[i].Line})
+		}
+	} else if caller, ok := entry.Data["caller"].(stack.Frame); ok {
+		frames = []sentryFrame{{Filename: caller.File, Function: caller.Name, Lineno: caller.Line}}
+	}
+	if frames != nil {
+		exceptions[len(exceptions)-1].Stacktrace = &sentryStacktrace{Frames: frames}
+	}
+	event.Exception = &sentryExceptions{Values: exceptions}
+	return event
+}
+
+// errorChain returns err and the errors it wraps, innermost cause first as
+// Sentry expects. Both Unwrap and github.com/pkg/errors' Cause are followed.
+func errorChain(err error) []sentryException {
+	var chain []sentryException
+	for i := 0; err != nil && i < 32; i++ {
+		chain = append([]sentryException{{Type: fmt.Sprintf("%T", err), Value: err.Error()}}, chain...)
+		switch x := err.(type) {
+		case interface{ Unwrap() error }:
+			err = x.Unwrap()
+		case interface{ Cause() error }:
+			err = x.Cause()
+		default:
+			err = nil
+		}
+	}
+	return chain
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *SentryHook) send(items []interface{}) error {
+	var failed int
+	var lastErr error
+	for _, item := range items {
+		event := item.(*sentryEvent)
+		body, err := h.envelope(event)
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		header := http.Header{}
+		header.Set("Content-Type", "application/x-sentry-envelope")
+		header.Set("X-Sentry-Auth", h.auth)
+		err = h.retry.do(func() error {
+			_, err := post(h.config.Client, h.envelopeURL, body, header)
+			return err
+		})
+		if err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		return &partialError{dropped: failed, total: len(items), err: lastErr}
+	}
+	return nil
+}
+
+func (h *SentryHook) envelope(event *sentryEvent) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.Encode(map[string]string{
+		"event_id": event.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+		"dsn":      h.config.DSN,
+	})
+	enc.Encode(map[string]interface{}{"type": "event", "length": len(payload)})
+	b.Write(payload)
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,128 @@
+package epiclogger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSentryHook(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sentry/api/42/envelope/", r.URL.Path)
+		assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=public")
+		scanner := bufio.NewScanner(r.Body)
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		assert.Equal(t, 3, len(lines))
+		var item map[string]interface{}
+		json.Unmarshal([]byte(lines[1]), &item)
+		assert.Equal(t, "event", item["type"])
+		assert.Equal(t, float64(len(lines[2])), item["length"])
+		var event map[string]interface{}
+		json.Unmarshal([]byte(lines[2]), &event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "://", "://public@", 1) + "/sentry/42"
+	hook, err := NewSentryHook(SentryConfig{DSN: dsn, Environment: "staging"})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"author_id", "this_author_id",
+		"correlation_id", "this_correlation_id",
+	))
+	logger.WithCtx(ctx).Info("loading")
+	logger.WithCtx(context.Background()).Info("other context")
+	cause := errors.New("connection refused")
+	logger.WithCtx(ctx).WithError(fmt.Errorf("query failed: %w", cause)).Error("failed")
+	assert.NoError(t, hook.Close())
+
+	assert.Equal(t, 1, len(events))
+	event := events[0]
+	assert.Equal(t, "error", event["level"])
+	assert.Equal(t, "staging", event["environment"])
+	assert.Equal(t, map[string]interface{}{"id": "this_author_id"}, event["user"])
+	assert.Equal(t, "this_correlation_id", event["tags"].(map[string]interface{})["correlation_id"])
+
+	exceptions := event["exception"].(map[string]interface{})["values"].([]interface{})
+	assert.Equal(t, 2, len(exceptions))
+	assert.Equal(t, "connection refused", exceptions[0].(map[string]interface{})["value"])
+	assert.Equal(t, "query failed: connection refused", exceptions[1].(map[string]interface{})["value"])
+
+	breadcrumbs := event["breadcrumbs"].([]interface{})
+	assert.Equal(t, 1, len(breadcrumbs))
+	assert.Equal(t, "loading", breadcrumbs[0].(map[string]interface{})["message"])
+}
+
+func TestSentryBreadcrumbsWithLoggerExtractors(t *testing.T) {
+	hook, err := NewSentryHook(SentryConfig{DSN: "http://public@sentry.invalid/42"})
+	assert.NoError(t, err)
+	defer hook.Close()
+
+	logger := NewEpicLogger(ioutil.Discard)
+	requests := logger.WithContextExtractors(MetadataField("x-request-id", "requestId"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "req-1"))
+	_, firstKey := sentryContext(requests.WithCtx(ctx).Entry)
+	_, secondKey := sentryContext(requests.WithCtx(ctx).Entry)
+	assert.NotNil(t, firstKey)
+	assert.Equal(t, firstKey, secondKey, "breadcrumbs kept under the logged context")
+
+	hook.addBreadcrumb(firstKey, requests.WithCtx(ctx).Entry)
+	assert.Equal(t, 1, len(hook.breadcrumbsFor(secondKey)))
+}
+
+func TestSentryInvalidDSN(t *testing.T) {
+	for _, dsn := range []string{"", "https://sentry.example.com/42", "https://public@sentry.example.com/"} {
+		_, err := NewSentryHook(SentryConfig{DSN: dsn})
+		assert.Error(t, err, dsn)
+	}
+}
+
+func TestSentryLogLevels(t *testing.T) {
+	var mu sync.Mutex
+	var levels []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lines, _ := ioutil.ReadAll(r.Body)
+		var event map[string]interface{}
+		json.Unmarshal([]byte(strings.Split(string(lines), "\n")[2]), &event)
+		mu.Lock()
+		levels = append(levels, event["level"].(string))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "://", "://public@", 1) + "/42"
+	hook, err := NewSentryHook(SentryConfig{DSN: dsn, LogLevels: []logrus.Level{logrus.PanicLevel}})
+	assert.NoError(t, err)
+
+	logger := NewEpicLogger(ioutil.Discard)
+	logger.Logger.Hooks.Add(hook)
+	logger.Error("not sent")
+	entry := logger.WithField("a", 1).Entry
+	entry.Level = logrus.PanicLevel
+	entry.Message = "sent"
+	assert.NoError(t, hook.Fire(entry))
+	assert.NoError(t, hook.Close())
+	assert.Equal(t, []string{"fatal"}, levels)
+}
@@ -0,0 +1,496 @@
+package epiclogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults shared by the network sinks.
+const (
+	DefaultBatchCount    = 500
+	DefaultBatchBytes    = 1024 * 1024
+	DefaultFlushInterval = 5 * time.Second
+	DefaultQueueSize     = 10000
+	DefaultMaxRetries    = 5
+	DefaultRetryBackoff  = 500 * time.Millisecond
+	maxRetryBackoff      = 30 * time.Second
+	dropReportInterval   = time.Minute
+)
+
+// reportError is used by the sinks for errors that can't be logged through
+// the logger they are part of.
+func reportError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "epiclogger: "+format+"\n", args...)
+}
+
+// StatusError is returned by the sinks when a collector answers with a
+// non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether retrying the request may succeed.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func isRetryable(err error) bool {
+	if t, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return t.Temporary()
+	}
+	// network errors and the like
+	return true
+}
+
+type retryPolicy struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	retries uint64
+
+	maxRetries int
+	backoff    time.Duration
+}
+
+func newRetryPolicy(maxRetries int, backoff time.Duration) *retryPolicy {
+	return &retryPolicy{
+		maxRetries: limit(maxRetries, DefaultMaxRetries),
+		backoff:    durationOr(backoff, DefaultRetryBackoff),
+	}
+}
+
+// do calls fn until it succeeds, fails with a permanent error or runs out of
+// retries, doubling the wait between attempts.
+func (p *retryPolicy) do(fn func() error) error {
+	wait := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= p.maxRetries {
+			return err
+		}
+		atomic.AddUint64(&p.retries, 1)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxRetryBackoff {
+			wait = maxRetryBackoff
+		}
+	}
+}
+
+func durationOr(value, defaultValue time.Duration) time.Duration {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// postJSON sends body as JSON and returns a *StatusError for non-2xx responses.
+func postJSON(client *http.Client, url string, body interface{}, header http.Header) ([]byte, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return post(client, url, b, header)
+}
+
+func post(client *http.Client, url string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return do(client, req)
+}
+
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBody, &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return respBody, err
+}
+
+type batchOptions struct {
+	count    int
+	bytes    int
+	interval time.Duration
+	queue    int
+}
+
+func newBatchOptions(count, bytes int, interval time.Duration, queue int) batchOptions {
+	return batchOptions{
+		count:    limit(count, DefaultBatchCount),
+		bytes:    limit(bytes, DefaultBatchBytes),
+		interval: durationOr(interval, DefaultFlushInterval),
+		queue:    limit(queue, DefaultQueueSize),
+	}
+}
+
+// partialError is returned by a batch send function when only some of the
+// items were lost. The retry items aren't lost: they are sent again with the
+// next batch.
+type partialError struct {
+	dropped int
+	total   int
+	err     error
+	retry   []interface{}
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("%d of %d items not sent: %v", e.dropped+len(e.retry), e.total, e.err)
+}
+
+type batchItem struct {
+	value interface{}
+	size  int
+}
+
+// batcher groups the items added to it and hands them to send when a batch
+// is full by count or size, when the flush interval elapses, on flush and on
+// close. send runs on a single goroutine so it never blocks the logger.
+type batcher struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	dropped uint64
+
+	opts    batchOptions
+	send    func(items []interface{}) error
+	queue   chan batchItem
+	flushes chan chan error
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newBatcher(opts batchOptions, send func(items []interface{}) error) *batcher {
+	b := &batcher{
+		opts:    opts,
+		send:    send,
+		queue:   make(chan batchItem, opts.queue),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// add queues value without blocking, it returns false when the value had to
+// be dropped because the queue is full or the batcher is closed.
+func (b *batcher) add(value interface{}, size int) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		atomic.AddUint64(&b.dropped, 1)
+		return false
+	}
+	select {
+	case b.queue <- batchItem{value: value, size: size}:
+		return true
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+		return false
+	}
+}
+
+// flush sends everything queued so far and waits for it to be sent.
+func (b *batcher) flush() error {
+	// not locked while waiting for send, which would block add behind a
+	// concurrent close
+	b.mu.RLock()
+	closed := b.closed
+	b.mu.RUnlock()
+	if closed {
+		return nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case b.flushes <- reply:
+		return <-reply
+	case <-b.done:
+		// closed meanwhile, which sent the queue
+		return nil
+	}
+}
+
+// close flushes the queue and stops the batcher.
+func (b *batcher) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batcher) depth() int {
+	return len(b.queue)
+}
+
+// dropReporter counts the entries dropped because a queue is full, and warns
+// on stderr every interval while they are dropped, rather than failing each
+// Fire and flooding stderr with the logrus hook errors.
+type dropReporter struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	dropped uint64
+
+	name string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newDropReporter(name string, interval time.Duration) *dropReporter {
+	r := &dropReporter{
+		name: name,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+func (r *dropReporter) add() {
+	atomic.AddUint64(&r.dropped, 1)
+}
+
+func (r *dropReporter) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-r.stop:
+			if dropped := atomic.LoadUint64(&r.dropped); dropped > last {
+				reportError("%s queue full, %d entries dropped before closing", r.name, dropped-last)
+			}
+			return
+		case <-ticker.C:
+		}
+		dropped := atomic.LoadUint64(&r.dropped)
+		if dropped > last {
+			reportError("%s queue full, %d entries dropped in the last %v", r.name, dropped-last, interval)
+		}
+		last = dropped
+	}
+}
+
+// close stops the warnings, reporting the drops not reported yet.
+func (r *dropReporter) close() {
+	select {
+	case <-r.stop:
+		return
+	default:
+		close(r.stop)
+	}
+	<-r.done
+}
+
+// batchSink is embedded in the sinks sending their entries in the background
+// through a batcher.
+type batchSink struct {
+	batcher *batcher
+	drops   *dropReporter
+}
+
+func (s *batchSink) start(name string, opts batchOptions, send func(items []interface{}) error) {
+	s.batcher = newBatcher(opts, send)
+	s.drops = newDropReporter(name, dropReportInterval)
+}
+
+// add queues value and reports whether it was queued. Values dropped because
+// the queue is full are counted and reported periodically.
+func (s *batchSink) add(value interface{}, size int) bool {
+	if !s.batcher.add(value, size) {
+		s.drops.add()
+		return false
+	}
+	return true
+}
+
+// queue adds the value built from entry, and flushes the queue when entry
+// is the last one before logrus exits or panics.
+func (s *batchSink) queue(entry *log.Entry, value interface{}, size int) error {
+	s.add(value, size)
+	// logrus exits or panics right after firing the hooks
+	if entry.Level <= log.FatalLevel {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush sends the queued entries and waits for them to be sent.
+func (s *batchSink) Flush() error {
+	return s.batcher.flush()
+}
+
+// Close sends the queued entries and stops the background goroutines.
+func (s *batchSink) Close() error {
+	s.batcher.close()
+	s.drops.close()
+	return nil
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.opts.interval)
+	defer ticker.Stop()
+
+	var pending, retrying []interface{}
+	var pendingBytes int
+	sendPending := func() error {
+		if len(pending) == 0 && len(retrying) == 0 {
+			return nil
+		}
+		items := append(retrying, pending...)
+		retrying = nil
+		err := b.send(items)
+		if err != nil {
+			dropped := len(items)
+			if partial, ok := err.(*partialError); ok {
+				dropped, retrying = partial.dropped, partial.retry
+				// the items waiting to be sent again count towards the queue size
+				if over := len(retrying) - b.opts.queue; over > 0 {
+					dropped, retrying = dropped+over, retrying[over:]
+				}
+			}
+			if dropped > 0 {
+				reportError("dropped %d entries: %v", dropped, err)
+				atomic.AddUint64(&b.dropped, uint64(dropped))
+			}
+		}
+		pending, pendingBytes = nil, 0
+		return err
+	}
+
+	for {
+		select {
+		case item, ok := <-b.queue:
+			if !ok {
+				sendPending()
+				if len(retrying) > 0 {
+					reportError("dropped %d entries not sent before closing", len(retrying))
+					atomic.AddUint64(&b.dropped, uint64(len(retrying)))
+				}
+				return
+			}
+			if len(pending) > 0 && pendingBytes+item.size > b.opts.bytes {
+				sendPending()
+			}
+			pending = append(pending, item.value)
+			pendingBytes += item.size
+			if len(pending) >= b.opts.count || pendingBytes >= b.opts.bytes {
+				sendPending()
+			}
+		case reply := <-b.flushes:
+			var err error
+			for drained := false; !drained; {
+				select {
+				case item, ok := <-b.queue:
+					if !ok {
+						drained = true
+						break
+					}
+					pending = append(pending, item.value)
+					pendingBytes += item.size
+					if len(pending) >= b.opts.count || pendingBytes >= b.opts.bytes {
+						if sendErr := sendPending(); sendErr != nil {
+							err = sendErr
+						}
+					}
+				default:
+					drained = true
+				}
+			}
+			if sendErr := sendPending(); sendErr != nil {
+				err = sendErr
+			}
+			reply <- err
+		case <-ticker.C:
+			sendPending()
+		}
+	}
+}
+
+// rateLimiter is a token bucket allowing rate events per second with bursts
+// of up to burst events.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until an event is allowed.
+func (l *rateLimiter) wait() {
+	l.take(true)
+}
+
+// allow reports whether an event is allowed now, without waiting.
+func (l *rateLimiter) allow() bool {
+	return l.take(false)
+}
+
+func (l *rateLimiter) take(block bool) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 && !block {
+		l.mu.Unlock()
+		return false
+	}
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+	return true
+}
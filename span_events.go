@@ -0,0 +1,130 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// SpanEventConfig configures a SpanEventHook.
+type SpanEventConfig struct {
+	// LogLevels are the levels recorded as span events, warning and above
+	// when nil.
+	LogLevels []log.Level
+
+	// Formatter collects the fields like the JSON output does.
+	Formatter *EpicFormatter
+}
+
+// SpanEventHook records the entries logged with a context carrying a
+// recording OpenTelemetry span as events of that span, with the fields as
+// attributes. Entries at error level and above set the span status to Error.
+type SpanEventHook struct {
+	config SpanEventConfig
+}
+
+// NewSpanEventHook returns a hook recording entries as span events.
+func NewSpanEventHook(config SpanEventConfig) *SpanEventHook {
+	if config.LogLevels == nil {
+		config.LogLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+	}
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	return &SpanEventHook{config: config}
+}
+
+// Levels implements logrus.Hook.
+func (h *SpanEventHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *SpanEventHook) Fire(entry *log.Entry) error {
+	var span trace.Span
+	for _, v := range entry.Data {
+		if ctx, ok := v.(context.Context); ok {
+			if s := trace.SpanFromContext(ctx); s.IsRecording() {
+				span = s
+				break
+			}
+		}
+	}
+	if span == nil {
+		return nil
+	}
+
+	data, httpReq, err := h.config.Formatter.collectFields(entry)
+	if err != nil {
+		return err
+	}
+	attributes := []attribute.KeyValue{attribute.String("log.severity", getSeverity(entry.Level))}
+	for _, kv := range otlpAttributes(otelAttributes(data, httpReq)) {
+		attributes = append(attributes, spanAttribute(kv))
+	}
+	span.AddEvent(entry.Message, trace.WithTimestamp(entry.Time), trace.WithAttributes(attributes...))
+	if entry.Level <= log.ErrorLevel {
+		description := entry.Message
+		if err, ok := entry.Data[log.ErrorKey].(error); ok {
+			description = fmt.Sprintf("%s: %v", entry.Message, err)
+		}
+		span.SetStatus(codes.Error, description)
+	}
+	return nil
+}
+
+// spanAttribute converts an OTLP attribute to a span attribute. Span
+// attributes can't nest, arrays of mixed types and maps are set as JSON.
+func spanAttribute(kv otlpKeyValue) attribute.KeyValue {
+	switch x := kv.value.(type) {
+	case string:
+		return attribute.String(kv.key, x)
+	case bool:
+		return attribute.Bool(kv.key, x)
+	case int64:
+		return attribute.Int64(kv.key, x)
+	case float64:
+		return attribute.Float64(kv.key, x)
+	case []interface{}:
+		values := make([]string, 0, len(x))
+		for _, item := range x {
+			s, ok := item.(string)
+			if !ok {
+				break
+			}
+			values = append(values, s)
+		}
+		if len(values) == len(x) {
+			return attribute.StringSlice(kv.key, values)
+		}
+	}
+	b, err := json.Marshal(plainValue(kv.value))
+	if err != nil {
+		return attribute.String(kv.key, fmt.Sprint(kv.value))
+	}
+	return attribute.String(kv.key, string(b))
+}
+
+// plainValue turns an OTLP value back into plain maps and slices.
+func plainValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i, item := range x {
+			values[i] = plainValue(item)
+		}
+		return values
+	case []otlpKeyValue:
+		m := make(map[string]interface{}, len(x))
+		for _, kv := range x {
+			m[kv.key] = plainValue(kv.value)
+		}
+		return m
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+package epiclogger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// recordingSpan records the events and status set by the hook.
+type recordingSpan struct {
+	trace.Span
+	events      []string
+	attributes  []attribute.KeyValue
+	status      codes.Code
+	description string
+}
+
+func (s *recordingSpan) IsRecording() bool { return true }
+
+func (s *recordingSpan) AddEvent(name string, options ...trace.EventOption) {
+	s.events = append(s.events, name)
+	config := trace.NewEventConfig(options...)
+	s.attributes = config.Attributes()
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, description string) {
+	s.status, s.description = code, description
+}
+
+func TestSpanEventHook(t *testing.T) {
+	span := &recordingSpan{}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+	logger := logrus.New()
+	logger.Hooks.Add(NewSpanEventHook(SpanEventConfig{}))
+
+	logger.WithField("ctx", ctx).Info("not recorded")
+	logger.WithFields(logrus.Fields{"ctx": ctx, "tags": []string{"a", "b"}, "cart": map[string]int{"items": 2}}).Warn("slow checkout")
+	assert.Equal(t, []string{"slow checkout"}, span.events)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("log.severity", "WARNING"),
+		attribute.String("cart", `{"items":2}`),
+		attribute.StringSlice("tags", []string{"a", "b"}),
+	}, span.attributes)
+	assert.Equal(t, codes.Unset, span.status)
+
+	logger.WithField("ctx", ctx).WithError(errors.New("card declined")).Error("payment failed")
+	assert.Equal(t, codes.Error, span.status)
+	assert.Equal(t, "payment failed: card declined", span.description)
+}
+
+func TestSpanEventHookWithoutSpan(t *testing.T) {
+	hook := NewSpanEventHook(SpanEventConfig{})
+	assert.NoError(t, hook.Fire(logrus.WithField("ctx", context.Background())))
+}
@@ -0,0 +1,306 @@
+package epiclogger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the Splunk sink.
+const (
+	DefaultSplunkSourceType      = "_json"
+	DefaultSplunkAckTimeout      = time.Minute
+	DefaultSplunkAckPollInterval = time.Second
+)
+
+// SplunkConfig configures a SplunkHook.
+type SplunkConfig struct {
+	// URL is the HTTP Event Collector base URL, e.g. https://splunk:8088
+	URL string
+
+	// Token is the HEC token.
+	Token string
+
+	// Raw sends the EpicFormatter JSON lines to the raw endpoint instead of
+	// events to the event endpoint.
+	Raw bool
+
+	// The metadata of the events. Source defaults to the service field of
+	// the entry, Host to the host name, SourceType to
+	// DefaultSplunkSourceType and Index to the collector's default.
+	Host       string
+	Source     string
+	SourceType string
+	Index      string
+
+	// ServiceMetadata takes the metadata left empty above from the service
+	// context of each entry: SourceType and Index are the service field,
+	// Host is the service and version fields as "service-version". The
+	// token must be allowed to write to the index of every service.
+	ServiceMetadata bool
+
+	// UseAck waits for the indexer acknowledgement of every batch, polling
+	// every AckPollInterval. Batches not acknowledged within AckTimeout are
+	// sent again. The token must have indexer acknowledgement enabled.
+	UseAck          bool
+	AckTimeout      time.Duration
+	AckPollInterval time.Duration
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// Formatter builds the event of each entry.
+	Formatter *EpicFormatter
+
+	// LogLevels are the levels sent, all of them when nil.
+	LogLevels []log.Level
+
+	// BatchCount, BatchBytes and FlushInterval bound the batches.
+	BatchCount    int
+	BatchBytes    int
+	FlushInterval time.Duration
+
+	// QueueSize is the number of entries kept in memory while waiting to be
+	// sent, new entries are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control retries of failed batches.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// SplunkHook sends entries to a Splunk HTTP Event Collector.
+type SplunkHook struct {
+	config   SplunkConfig
+	hostname string
+	channel  string
+	retry    *retryPolicy
+	batchSink
+}
+
+type hecEvent struct {
+	Time float64 `json:"time"`
+	hecMetadata
+	Event  interface{}       `json:"event"`
+	Fields map[string]string `json:"fields,omitempty"`
+
+	line []byte
+}
+
+type hecMetadata struct {
+	Host       string `json:"host,omitempty"`
+	Source     string `json:"source,omitempty"`
+	SourceType string `json:"sourcetype,omitempty"`
+	Index      string `json:"index,omitempty"`
+}
+
+// NewSplunkHook returns a hook sending entries in the background. Close it
+// before exiting to send the last entries.
+func NewSplunkHook(config SplunkConfig) (*SplunkHook, error) {
+	if config.URL == "" || config.Token == "" {
+		return nil, fmt.Errorf("epiclogger: a Splunk URL and Token are required")
+	}
+	config.AckTimeout = durationOr(config.AckTimeout, DefaultSplunkAckTimeout)
+	config.AckPollInterval = durationOr(config.AckPollInterval, DefaultSplunkAckPollInterval)
+	if config.Formatter == nil {
+		config.Formatter = &EpicFormatter{}
+	}
+	if config.LogLevels == nil {
+		config.LogLevels = log.AllLevels
+	}
+	h := &SplunkHook{
+		config:  config,
+		channel: newChannelID(),
+		retry:   newRetryPolicy(config.MaxRetries, config.RetryBackoff),
+	}
+	h.hostname, _ = os.Hostname()
+	h.start("splunk", newBatchOptions(config.BatchCount, config.BatchBytes, config.FlushInterval, config.QueueSize), h.send)
+	return h, nil
+}
+
+// newChannelID returns a random UUID identifying the hook to the collector.
+func newChannelID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Levels implements logrus.Hook.
+func (h *SplunkHook) Levels() []log.Level {
+	return h.config.LogLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *SplunkHook) Fire(entry *log.Entry) error {
+	event, err := h.event(entry)
+	if err != nil {
+		return err
+	}
+	return h.queue(entry, event, len(event.line))
+}
+
+// event builds the HEC event of entry, with its metadata and fields.
+func (h *SplunkHook) event(entry *log.Entry) (*hecEvent, error) {
+	payload, err := h.config.Formatter.FormatMap(entry)
+	if err != nil {
+		return nil, err
+	}
+	event := &hecEvent{
+		Time: float64(entry.Time.UnixNano()/int64(time.Millisecond)) / 1000,
+		hecMetadata: hecMetadata{
+			Host:       h.config.Host,
+			Source:     h.config.Source,
+			SourceType: h.config.SourceType,
+			Index:      h.config.Index,
+		},
+		Event: payload,
+	}
+	service, _ := entry.Data["service"].(string)
+	version, _ := entry.Data["version"].(string)
+	if service != "" {
+		if event.Source == "" {
+			event.Source = service
+		}
+		if h.config.ServiceMetadata {
+			if event.SourceType == "" {
+				event.SourceType = service
+			}
+			if event.Index == "" {
+				event.Index = service
+			}
+			if event.Host == "" && version != "" {
+				event.Host = service + "-" + version
+			}
+		}
+	}
+	if event.Host == "" {
+		event.Host = h.hostname
+	}
+	if event.SourceType == "" {
+		event.SourceType = DefaultSplunkSourceType
+	}
+	if version != "" {
+		event.Fields = map[string]string{"version": version}
+	}
+	if event.line, err = json.Marshal(payload); err != nil {
+		return nil, err
+	}
+	if !h.config.Raw {
+		// the event is serialized as a whole when sent
+		event.line, err = json.Marshal(event)
+	}
+	return event, err
+}
+
+func (h *SplunkHook) header() http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Splunk "+h.config.Token)
+	header.Set("X-Splunk-Request-Channel", h.channel)
+	return header
+}
+
+func (h *SplunkHook) send(items []interface{}) error {
+	base := strings.TrimSuffix(h.config.URL, "/")
+	if !h.config.Raw {
+		var body bytes.Buffer
+		for _, item := range items {
+			body.Write(item.(*hecEvent).line)
+		}
+		return h.post(base+"/services/collector/event", body.Bytes())
+	}
+
+	// the metadata of raw events goes in the query, one request per metadata
+	var groups []hecMetadata
+	lines := map[hecMetadata]*bytes.Buffer{}
+	counts := map[hecMetadata]int{}
+	for _, item := range items {
+		event := item.(*hecEvent)
+		if lines[event.hecMetadata] == nil {
+			groups = append(groups, event.hecMetadata)
+			lines[event.hecMetadata] = &bytes.Buffer{}
+		}
+		lines[event.hecMetadata].Write(event.line)
+		lines[event.hecMetadata].WriteByte('\n')
+		counts[event.hecMetadata]++
+	}
+	var failed int
+	var lastErr error
+	for _, metadata := range groups {
+		query := url.Values{"channel": {h.channel}}
+		for k, v := range map[string]string{"host": metadata.Host, "source": metadata.Source, "sourcetype": metadata.SourceType, "index": metadata.Index} {
+			if v != "" {
+				query.Set(k, v)
+			}
+		}
+		if err := h.post(base+"/services/collector/raw?"+query.Encode(), lines[metadata].Bytes()); err != nil {
+			failed += counts[metadata]
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		return &partialError{dropped: failed, total: len(items), err: lastErr}
+	}
+	return nil
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// post sends a batch, and waits for its acknowledgement when UseAck is set.
+func (h *SplunkHook) post(url string, body []byte) error {
+	return h.retry.do(func() error {
+		respBody, err := post(h.config.Client, url, body, h.header())
+		if err != nil || !h.config.UseAck {
+			return err
+		}
+		var resp hecResponse
+		if err := json.Unmarshal(respBody, &resp); err != nil || resp.AckID == nil {
+			return fmt.Errorf("no ackId in the collector response %q", respBody)
+		}
+		return h.waitAck(*resp.AckID)
+	})
+}
+
+// waitAck polls the ack endpoint until the batch is indexed, and returns an
+// error when it isn't after AckTimeout.
+func (h *SplunkHook) waitAck(id int64) error {
+	ackURL := strings.TrimSuffix(h.config.URL, "/") + "/services/collector/ack?channel=" + url.QueryEscape(h.channel)
+	deadline := time.Now().Add(h.config.AckTimeout)
+	for {
+		body, err := json.Marshal(map[string][]int64{"acks": {id}})
+		if err != nil {
+			return err
+		}
+		respBody, err := post(h.config.Client, ackURL, body, h.header())
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return err
+		}
+		if resp.Acks[strconv.FormatInt(id, 10)] {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("batch %d not acknowledged after %v", id, h.config.AckTimeout)
+		}
+		time.Sleep(h.config.AckPollInterval)
+	}
+}
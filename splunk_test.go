@@ -0,0 +1,153 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHEC is a HTTP Event Collector acknowledging batches on the second poll.
+type fakeHEC struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	polls    int
+}
+
+func (f *fakeHEC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Splunk token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"text":"Invalid token","code":4}`))
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path == "/services/collector/ack" {
+		f.polls++
+		w.Write([]byte(`{"acks":{"0":` + map[bool]string{true: "true", false: "false"}[f.polls > 1] + `}}`))
+		return
+	}
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(body))
+	w.Write([]byte(`{"text":"Success","code":0,"ackId":0}`))
+}
+
+func newSplunkEntry(message string) *logrus.Entry {
+	entry := logrus.WithFields(logrus.Fields{"service": "billing", "version": "1.2"})
+	entry.Level = logrus.InfoLevel
+	entry.Time = time.Unix(1500000000, 123000000)
+	entry.Message = message
+	return entry
+}
+
+func TestSplunkHookEvents(t *testing.T) {
+	hec := &fakeHEC{}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	hook, err := NewSplunkHook(SplunkConfig{
+		URL:             server.URL,
+		Token:           "token",
+		Host:            "web-1",
+		Index:           "audit",
+		UseAck:          true,
+		AckPollInterval: time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newSplunkEntry("first")))
+	second := newSplunkEntry("second")
+	second.Data = logrus.Fields{}
+	assert.NoError(t, hook.Fire(second))
+	assert.NoError(t, hook.Close())
+
+	assert.Equal(t, 1, len(hec.requests))
+	assert.Equal(t, "/services/collector/event", hec.requests[0].URL.Path)
+	assert.NotEmpty(t, hec.requests[0].Header.Get("X-Splunk-Request-Channel"))
+	assert.Equal(t, 2, hec.polls)
+
+	decoder := json.NewDecoder(strings.NewReader(hec.bodies[0]))
+	var event map[string]interface{}
+	assert.NoError(t, decoder.Decode(&event))
+	assert.Equal(t, 1500000000.123, event["time"])
+	assert.Equal(t, "web-1", event["host"])
+	assert.Equal(t, "billing", event["source"])
+	assert.Equal(t, "_json", event["sourcetype"])
+	assert.Equal(t, "audit", event["index"])
+	assert.Equal(t, map[string]interface{}{"version": "1.2"}, event["fields"])
+	assert.Equal(t, "first", event["event"].(map[string]interface{})["message"])
+	event = nil
+	assert.NoError(t, decoder.Decode(&event))
+	assert.Equal(t, "second", event["event"].(map[string]interface{})["message"])
+	assert.Equal(t, "web-1", event["host"])
+	assert.Nil(t, event["source"])
+	assert.Equal(t, "_json", event["sourcetype"])
+	assert.Equal(t, "audit", event["index"])
+}
+
+func TestSplunkHookRaw(t *testing.T) {
+	hec := &fakeHEC{}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	hook, err := NewSplunkHook(SplunkConfig{URL: server.URL, Token: "token", Raw: true, ServiceMetadata: true})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newSplunkEntry("raw line")))
+	assert.NoError(t, hook.Close())
+
+	assert.Equal(t, 1, len(hec.requests))
+	query := hec.requests[0].URL.Query()
+	assert.Equal(t, "/services/collector/raw", hec.requests[0].URL.Path)
+	assert.Equal(t, "billing", query.Get("source"))
+	assert.Equal(t, "billing", query.Get("sourcetype"))
+	assert.Equal(t, "billing", query.Get("index"))
+	assert.Equal(t, "billing-1.2", query.Get("host"))
+	assert.NotEmpty(t, query.Get("channel"))
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(hec.bodies[0]), &line))
+	assert.Equal(t, "raw line", line["message"])
+}
+
+func TestSplunkHookInvalidToken(t *testing.T) {
+	server := httptest.NewServer(&fakeHEC{})
+	defer server.Close()
+
+	hook, err := NewSplunkHook(SplunkConfig{URL: server.URL, Token: "wrong"})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newSplunkEntry("rejected")))
+	assert.Error(t, hook.Flush())
+	assert.Equal(t, uint64(0), hook.retry.retries)
+	hook.Close()
+}
+
+func TestSplunkHookRawPartialFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") == "missing" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"text":"Incorrect index","code":7}`))
+			return
+		}
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer server.Close()
+
+	hook, err := NewSplunkHook(SplunkConfig{URL: server.URL, Token: "token", Raw: true, ServiceMetadata: true})
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newSplunkEntry("first")))
+	assert.NoError(t, hook.Fire(newSplunkEntry("second")))
+	missing := newSplunkEntry("lost")
+	missing.Data = logrus.Fields{"service": "missing"}
+	assert.NoError(t, hook.Fire(missing))
+	assert.EqualError(t, hook.Flush(), `1 of 3 items not sent: unexpected status 400: {"text":"Incorrect index","code":7}`)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&hook.batcher.dropped))
+	hook.Close()
+}
@@ -0,0 +1,737 @@
+package epiclogger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Defaults of the disk spool.
+const (
+	DefaultSpoolSegmentBytes  = 8 * 1024 * 1024
+	DefaultSpoolMaxBytes      = 1024 * 1024 * 1024
+	DefaultSpoolRetryInterval = 5 * time.Second
+	DefaultSpoolMaxAttempts   = 5
+)
+
+const (
+	segmentSuffix   = ".seg"
+	cursorFile      = "cursor"
+	spoolHeaderSize = 8
+)
+
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// SpoolConfig configures the disk spool of a SpoolHook or a SpoolWriter.
+type SpoolConfig struct {
+	// Dir keeps the segment files and the replay cursor. It must not be
+	// shared by several spools or processes.
+	Dir string
+
+	// SegmentBytes is the size after which a new segment file is started,
+	// DefaultSpoolSegmentBytes when zero.
+	SegmentBytes int64
+
+	// MaxBytes bounds the size of Dir, DefaultSpoolMaxBytes when zero. The
+	// oldest segments are dropped once it is reached. It can't be lower
+	// than SegmentBytes.
+	MaxBytes int64
+
+	// Sync flushes every record to the disk before returning, so that
+	// none is lost when the machine crashes.
+	Sync bool
+
+	// RetryInterval is the wait before delivering again after a failure,
+	// DefaultSpoolRetryInterval when zero.
+	RetryInterval time.Duration
+
+	// MaxAttempts is the number of deliveries of a record failing with a
+	// permanent error, a 400 for instance, before it is dropped,
+	// DefaultSpoolMaxAttempts when zero. Records failing with a temporary
+	// error are retried until they are delivered.
+	MaxAttempts int
+}
+
+// spoolPosition is the position of a record in the spool.
+type spoolPosition struct {
+	seq uint64
+	off int64
+}
+
+func (p spoolPosition) before(other spoolPosition) bool {
+	return p.seq < other.seq || p.seq == other.seq && p.off < other.off
+}
+
+type spoolFlush struct {
+	target spoolPosition
+	reply  chan error
+}
+
+// spool is a write-ahead log of records split in segment files. Records are
+// framed with their length and CRC-32C, appended to the last segment and
+// handed to deliver in order by a single goroutine. deliver returns the
+// number of records it delivered before failing. The position of the first
+// record not delivered is saved in the cursor file, so delivery resumes
+// where it stopped after a restart. Records may be delivered twice when the
+// process stops between a delivery and the cursor update.
+type spool struct {
+	config  SpoolConfig
+	deliver func(records [][]byte) (int, error)
+
+	mu        sync.Mutex
+	segments  []uint64
+	sizes     map[uint64]int64
+	bytes     int64
+	active    *os.File
+	activeSeq uint64
+	cursor    spoolPosition
+	wake      chan struct{}
+	flushes   chan spoolFlush
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSpool(config SpoolConfig, deliver func(records [][]byte) (int, error)) (*spool, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("epiclogger: a spool Dir is required")
+	}
+	if config.SegmentBytes == 0 {
+		config.SegmentBytes = DefaultSpoolSegmentBytes
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = DefaultSpoolMaxBytes
+	}
+	if config.SegmentBytes > config.MaxBytes {
+		// the active segment is never dropped to enforce the quota
+		return nil, fmt.Errorf("epiclogger: the spool SegmentBytes can't be over its MaxBytes")
+	}
+	config.RetryInterval = durationOr(config.RetryInterval, DefaultSpoolRetryInterval)
+	config.MaxAttempts = limit(config.MaxAttempts, DefaultSpoolMaxAttempts)
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("epiclogger: can't create the spool: %v", err)
+	}
+	s := &spool{
+		config:  config,
+		deliver: deliver,
+		sizes:   map[uint64]int64{},
+		wake:    make(chan struct{}, 1),
+		flushes: make(chan spoolFlush),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("epiclogger: can't open the spool: %v", err)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// recover loads the segments and the cursor left by a previous run, and
+// truncates the last segment after its last complete record.
+func (s *spool) recover() error {
+	files, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+		s.sizes[seq] = file.Size()
+		s.bytes += file.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if b, err := ioutil.ReadFile(filepath.Join(s.config.Dir, cursorFile)); err == nil {
+		fmt.Sscanf(string(b), "%d %d", &s.cursor.seq, &s.cursor.off)
+	}
+
+	if len(s.segments) == 0 {
+		return s.newSegment(s.cursor.seq + 1)
+	}
+	last := s.segments[len(s.segments)-1]
+	valid, err := validLength(s.segmentPath(last))
+	if err != nil {
+		return err
+	}
+	if valid < s.sizes[last] {
+		reportError("truncating the incomplete records of spool segment %d", last)
+		if err := os.Truncate(s.segmentPath(last), valid); err != nil {
+			return err
+		}
+		s.bytes -= s.sizes[last] - valid
+		s.sizes[last] = valid
+	}
+	active, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.active, s.activeSeq = active, last
+
+	// the cursor segment may have been dropped or deleted
+	if _, ok := s.sizes[s.cursor.seq]; !ok {
+		wanted := s.cursor.seq
+		s.cursor = spoolPosition{seq: s.segments[0]}
+		for _, seq := range s.segments {
+			if seq >= wanted {
+				s.cursor = spoolPosition{seq: seq}
+				break
+			}
+		}
+	}
+	if s.cursor.off > s.sizes[s.cursor.seq] {
+		s.cursor.off = s.sizes[s.cursor.seq]
+	}
+	return nil
+}
+
+// validLength returns the length of the complete, uncorrupted records at the
+// start of a segment.
+func validLength(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var length int64
+	for {
+		record, err := readRecord(r)
+		if err != nil {
+			return length, nil
+		}
+		length += spoolHeaderSize + int64(len(record))
+	}
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// readRecord reads a record framed as its length and CRC-32C, both little
+// endian uint32, followed by its bytes.
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.LittleEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, errCorruptRecord
+	}
+	if crc32.Checksum(record, spoolCRC) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, errCorruptRecord
+	}
+	return record, nil
+}
+
+func (s *spool) newSegment(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active, s.activeSeq = f, seq
+	s.segments = append(s.segments, seq)
+	s.sizes[seq] = 0
+	if len(s.segments) == 1 {
+		s.cursor = spoolPosition{seq: seq}
+	}
+	return nil
+}
+
+// append writes a record at the end of the spool. The record is kept, and
+// delivered, when only the sync fails.
+func (s *spool) append(record []byte) error {
+	frame := make([]byte, spoolHeaderSize+len(record))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(record, spoolCRC))
+	copy(frame[spoolHeaderSize:], record)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return os.ErrClosed
+	}
+	if size := s.sizes[s.activeSeq]; size > 0 && size+int64(len(frame)) > s.config.SegmentBytes {
+		if err := s.newSegment(s.activeSeq + 1); err != nil {
+			return err
+		}
+	}
+	seq := s.activeSeq
+	n, err := s.active.Write(frame)
+	if err != nil {
+		// don't leave half a record for the next ones to follow
+		if n > 0 && s.active.Truncate(s.sizes[seq]) != nil {
+			s.sizes[seq] += int64(n)
+			s.bytes += int64(n)
+			if segmentErr := s.newSegment(seq + 1); segmentErr != nil {
+				reportError("can't start a new spool segment: %v", segmentErr)
+			}
+		}
+		return err
+	}
+	// the record is in the segment even when it can't be synced, the
+	// following ones must be written after it
+	s.sizes[seq] += int64(n)
+	s.bytes += int64(n)
+	if s.config.Sync {
+		err = s.active.Sync()
+	}
+	s.enforceQuota()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// enforceQuota drops the oldest segments while the spool is over MaxBytes.
+func (s *spool) enforceQuota() {
+	for s.bytes > s.config.MaxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		os.Remove(s.segmentPath(oldest))
+		reportError("spool over quota, dropped segment %d (%d bytes)", oldest, s.sizes[oldest])
+		s.bytes -= s.sizes[oldest]
+		delete(s.sizes, oldest)
+		s.segments = s.segments[1:]
+		if s.cursor.seq <= oldest {
+			s.cursor = spoolPosition{seq: s.segments[0]}
+			s.saveCursor()
+		}
+	}
+}
+
+func (s *spool) saveCursor() {
+	tmp := filepath.Join(s.config.Dir, cursorFile+".tmp")
+	content := fmt.Sprintf("%d %d\n", s.cursor.seq, s.cursor.off)
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		reportError("can't save the spool cursor: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(s.config.Dir, cursorFile)); err != nil {
+		reportError("can't save the spool cursor: %v", err)
+	}
+}
+
+// end returns the position after the last record.
+func (s *spool) end() spoolPosition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return spoolPosition{seq: s.activeSeq, off: s.sizes[s.activeSeq]}
+}
+
+// read returns the next records to deliver, up to a batch, and the position
+// following them. Segments read entirely are removed.
+func (s *spool) read() ([][]byte, spoolPosition, spoolPosition) {
+	for {
+		s.mu.Lock()
+		from := s.cursor
+		end := s.sizes[from.seq]
+		active := from.seq == s.activeSeq
+		if from.off >= end && !active {
+			os.Remove(s.segmentPath(from.seq))
+			s.bytes -= end
+			delete(s.sizes, from.seq)
+			for i, seq := range s.segments {
+				if seq == from.seq {
+					s.segments = append(s.segments[:i], s.segments[i+1:]...)
+					break
+				}
+			}
+			s.cursor = spoolPosition{seq: s.segments[0]}
+			s.saveCursor()
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		if from.off >= end {
+			return nil, from, from
+		}
+
+		records, next, err := s.readSegment(from, end)
+		if err != nil {
+			reportError("skipping the rest of spool segment %d after offset %d: %v", from.seq, next.off, err)
+			next.off = end
+		}
+		if len(records) == 0 {
+			s.commit(from, next)
+			continue
+		}
+		return records, from, next
+	}
+}
+
+func (s *spool) readSegment(from spoolPosition, end int64) ([][]byte, spoolPosition, error) {
+	next := from
+	f, err := os.Open(s.segmentPath(from.seq))
+	if err != nil {
+		return nil, next, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, from.off, end-from.off))
+	var records [][]byte
+	var size int
+	for next.off < end && len(records) < DefaultBatchCount && size < DefaultBatchBytes {
+		record, err := readRecord(r)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errCorruptRecord
+			}
+			return records, next, err
+		}
+		records = append(records, record)
+		size += len(record)
+		next.off += spoolHeaderSize + int64(len(record))
+	}
+	return records, next, nil
+}
+
+// after returns the position following records read at from.
+func after(from spoolPosition, records [][]byte) spoolPosition {
+	for _, record := range records {
+		from.off += spoolHeaderSize + int64(len(record))
+	}
+	return from
+}
+
+// commit moves the cursor after delivered records, unless the quota moved
+// it in the meantime.
+func (s *spool) commit(from, next spoolPosition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursor == from {
+		s.cursor = next
+		s.saveCursor()
+	}
+}
+
+func (s *spool) run() {
+	defer close(s.done)
+	var waiters []spoolFlush
+	answer := func(pos spoolPosition, err error) {
+		pending := waiters[:0]
+		for _, w := range waiters {
+			if err != nil || !pos.before(w.target) {
+				w.reply <- err
+			} else {
+				pending = append(pending, w)
+			}
+		}
+		waiters = pending
+	}
+
+	// the first record not delivered and its failed deliveries
+	var failing spoolPosition
+	var attempts int
+	for {
+		for drained := false; !drained; {
+			select {
+			case f := <-s.flushes:
+				waiters = append(waiters, f)
+			default:
+				drained = true
+			}
+		}
+
+		records, from, next := s.read()
+		if len(records) == 0 {
+			answer(next, nil)
+			select {
+			case <-s.wake:
+			case f := <-s.flushes:
+				waiters = append(waiters, f)
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+
+		n, err := s.deliver(records)
+		// the records delivered are never delivered again
+		delivered := after(from, records[:n])
+		if n > 0 {
+			s.commit(from, delivered)
+		}
+		if err == nil {
+			answer(next, nil)
+			continue
+		}
+		if n == len(records) {
+			// handed to the hook, only its flush failed
+			reportError("spooled entries not flushed: %v", err)
+			answer(next, err)
+			continue
+		}
+
+		if delivered != failing {
+			failing, attempts = delivered, 0
+		}
+		attempts++
+		if _, partial := err.(*partialError); (partial || !isRetryable(err)) && attempts >= s.config.MaxAttempts {
+			reportError("dropped a spooled entry after %d attempts: %v", attempts, err)
+			s.commit(delivered, after(delivered, records[n:n+1]))
+			continue
+		}
+		answer(delivered, err)
+		reportError("spooled entries not delivered, retrying in %v: %v", s.config.RetryInterval, err)
+		retry := time.NewTimer(s.config.RetryInterval)
+		for waiting := true; waiting; {
+			select {
+			case <-retry.C:
+				waiting = false
+			case f := <-s.flushes:
+				// try again right away
+				retry.Stop()
+				waiters = append(waiters, f)
+				waiting = false
+			case <-s.stop:
+				retry.Stop()
+				return
+			}
+		}
+	}
+}
+
+// flush waits until the records appended so far are delivered, or until a
+// delivery fails.
+func (s *spool) flush() error {
+	f := spoolFlush{target: s.end(), reply: make(chan error, 1)}
+	select {
+	case s.flushes <- f:
+	case <-s.done:
+		return nil
+	}
+	select {
+	case err := <-f.reply:
+		return err
+	case <-s.done:
+		return nil
+	}
+}
+
+// close stops the delivery and closes the active segment. The records not
+// delivered yet stay in Dir for the next run.
+func (s *spool) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		err = s.active.Close()
+		s.active = nil
+	})
+	return err
+}
+
+// SpoolHook writes the entries to a disk spool before handing them to hook,
+// so that they aren't lost while the collector behind hook is unreachable or
+// when the process restarts. The entries are replayed in order, at least
+// once. Fields are replayed as their JSON values, except the error field
+// which stays an error; contexts are not kept.
+type SpoolHook struct {
+	hook  log.Hook
+	spool *spool
+}
+
+type spooledEntry struct {
+	Time    time.Time                  `json:"time"`
+	Level   uint32                     `json:"level"`
+	Message string                     `json:"msg"`
+	Error   string                     `json:"error,omitempty"`
+	Data    map[string]json.RawMessage `json:"data,omitempty"`
+}
+
+// NewSpoolHook returns a hook spooling the entries for hook to config.Dir,
+// replaying the entries left there by a previous run first.
+func NewSpoolHook(hook log.Hook, config SpoolConfig) (*SpoolHook, error) {
+	h := &SpoolHook{hook: hook}
+	spool, err := newSpool(config, h.deliver)
+	if err != nil {
+		return nil, err
+	}
+	h.spool = spool
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *SpoolHook) Levels() []log.Level {
+	return h.hook.Levels()
+}
+
+// Fire implements logrus.Hook.
+func (h *SpoolHook) Fire(entry *log.Entry) error {
+	spooled := spooledEntry{
+		Time:    entry.Time,
+		Level:   uint32(entry.Level),
+		Message: entry.Message,
+		Data:    make(map[string]json.RawMessage, len(entry.Data)),
+	}
+	for k, v := range entry.Data {
+		switch x := v.(type) {
+		case context.Context:
+			continue
+		case error:
+			if k == log.ErrorKey {
+				spooled.Error = x.Error()
+				continue
+			}
+			v = x.Error()
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(v))
+		}
+		spooled.Data[k] = b
+	}
+	record, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+	if err := h.spool.append(record); err != nil {
+		return fmt.Errorf("epiclogger: can't spool the entry: %v", err)
+	}
+	// logrus exits or panics right after firing the hooks
+	if entry.Level <= log.FatalLevel {
+		return h.Flush()
+	}
+	return nil
+}
+
+func (h *SpoolHook) deliver(records [][]byte) (int, error) {
+	for i, record := range records {
+		var spooled spooledEntry
+		if err := json.Unmarshal(record, &spooled); err != nil {
+			reportError("dropped a spooled entry: %v", err)
+			continue
+		}
+		entry := log.NewEntry(log.StandardLogger())
+		entry.Time = spooled.Time
+		entry.Level = log.Level(spooled.Level)
+		entry.Message = spooled.Message
+		for k, raw := range spooled.Data {
+			d := json.NewDecoder(bytes.NewReader(raw))
+			d.UseNumber()
+			var v interface{}
+			if d.Decode(&v) == nil {
+				entry.Data[k] = v
+			}
+		}
+		if spooled.Error != "" {
+			entry.Data[log.ErrorKey] = errors.New(spooled.Error)
+		}
+		if err := h.hook.Fire(entry); err != nil {
+			return i, err
+		}
+	}
+	if flusher, ok := h.hook.(interface {
+		Flush() error
+	}); ok {
+		return len(records), flusher.Flush()
+	}
+	return len(records), nil
+}
+
+// Flush waits until the spooled entries are handed to the hook and flushed,
+// or until it fails.
+func (h *SpoolHook) Flush() error {
+	return h.spool.flush()
+}
+
+// Close tries to deliver the spooled entries once, then stops the spool
+// and closes the hook.
+func (h *SpoolHook) Close() error {
+	h.Flush()
+	err := h.spool.close()
+	if closer, ok := h.hook.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// SpoolWriter writes to a disk spool before writing to w, like SpoolHook
+// does for hooks. Use it as the logger's Out in front of a network writer
+// such as a SyslogWriter.
+type SpoolWriter struct {
+	w     io.Writer
+	spool *spool
+}
+
+// NewSpoolWriter returns a writer spooling to config.Dir the data for w.
+func NewSpoolWriter(w io.Writer, config SpoolConfig) (*SpoolWriter, error) {
+	sw := &SpoolWriter{w: w}
+	spool, err := newSpool(config, sw.deliver)
+	if err != nil {
+		return nil, err
+	}
+	sw.spool = spool
+	return sw, nil
+}
+
+// Write implements io.Writer, p is delivered to w in a single Write.
+func (w *SpoolWriter) Write(p []byte) (int, error) {
+	if err := w.spool.append(p); err != nil {
+		return 0, fmt.Errorf("epiclogger: can't spool the entry: %v", err)
+	}
+	return len(p), nil
+}
+
+func (w *SpoolWriter) deliver(records [][]byte) (int, error) {
+	for i, record := range records {
+		if _, err := w.w.Write(record); err != nil {
+			return i, err
+		}
+	}
+	if flusher, ok := w.w.(interface {
+		Flush() error
+	}); ok {
+		return len(records), flusher.Flush()
+	}
+	return len(records), nil
+}
+
+// Flush waits until the spooled data is written to w and flushed, or until
+// it fails.
+func (w *SpoolWriter) Flush() error {
+	return w.spool.flush()
+}
+
+// Close tries to deliver the spooled data once, then stops the spool and
+// closes w.
+func (w *SpoolWriter) Close() error {
+	w.Flush()
+	err := w.spool.close()
+	if closer, ok := w.w.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package epiclogger
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyWriter fails until it is brought up.
+type flakyWriter struct {
+	mu    sync.Mutex
+	up    bool
+	lines []string
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.up {
+		return 0, errors.New("collector down")
+	}
+	w.lines = append(w.lines, string(p))
+	return len(p), nil
+}
+
+func (w *flakyWriter) setUp(up bool) {
+	w.mu.Lock()
+	w.up = up
+	w.mu.Unlock()
+}
+
+func (w *flakyWriter) written() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.lines...)
+}
+
+func TestSpoolWriterOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := &flakyWriter{}
+	w, err := NewSpoolWriter(out, SpoolConfig{Dir: dir, RetryInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		n, err := w.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.EqualError(t, w.Flush(), "collector down")
+
+	out.setUp(true)
+	assert.NoError(t, w.Flush())
+	w.Write([]byte("four\n"))
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n"}, out.written())
+}
+
+func TestSpoolWriterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := SpoolConfig{Dir: dir, SegmentBytes: 20, RetryInterval: 10 * time.Millisecond}
+	w, err := NewSpoolWriter(&flakyWriter{}, config)
+	assert.NoError(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		w.Write([]byte(line))
+	}
+	assert.NoError(t, w.Close())
+
+	// a crash in the middle of a record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(t, segments, 3)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	f.Write([]byte{42, 0, 0, 0, 1, 2})
+	f.Close()
+
+	out := &flakyWriter{up: true}
+	w, err = NewSpoolWriter(out, config)
+	assert.NoError(t, err)
+	w.Write([]byte("four\n"))
+	assert.NoError(t, w.Flush())
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n"}, out.written())
+
+	// everything delivered is gone
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(t, segments, 1)
+	w, err = NewSpoolWriter(out, config)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Len(t, out.written(), 4)
+}
+
+func TestSpoolCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := SpoolConfig{Dir: dir, SegmentBytes: 20, RetryInterval: 10 * time.Millisecond}
+	w, err := NewSpoolWriter(&flakyWriter{}, config)
+	assert.NoError(t, err)
+	for _, line := range []string{"one\n", "two\n"} {
+		w.Write([]byte(line))
+	}
+	assert.NoError(t, w.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	b, _ := ioutil.ReadFile(segments[0])
+	b[len(b)-2] = 'X'
+	ioutil.WriteFile(segments[0], b, 0600)
+
+	out := &flakyWriter{up: true}
+	w, err = NewSpoolWriter(out, config)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"two\n"}, out.written())
+}
+
+func TestSpoolQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := &flakyWriter{}
+	w, err := NewSpoolWriter(out, SpoolConfig{Dir: dir, SegmentBytes: 30, MaxBytes: 60, RetryInterval: time.Hour})
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		w.Write([]byte(strings.Repeat(string('a'+rune(i)), 7)))
+	}
+	var size int64
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	for _, segment := range segments {
+		info, _ := os.Stat(segment)
+		size += info.Size()
+	}
+	assert.True(t, size <= 60, "spool size %d", size)
+	w.spool.close()
+
+	w, err = NewSpoolWriter(out, SpoolConfig{Dir: dir, SegmentBytes: 30, MaxBytes: 60})
+	assert.NoError(t, err)
+	out.setUp(true)
+	assert.NoError(t, w.Close())
+	written := out.written()
+	if assert.NotEmpty(t, written) {
+		assert.True(t, len(written) < 20)
+		assert.Equal(t, "ttttttt", written[len(written)-1])
+	}
+
+	_, err = NewSpoolWriter(out, SpoolConfig{Dir: dir, SegmentBytes: 61, MaxBytes: 60})
+	assert.Error(t, err, "segments over the quota")
+}
+
+// recordingHook keeps the entries it is fired with.
+type recordingHook struct {
+	entries []*logrus.Entry
+	flushes int
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *logrus.Entry) error {
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func (h *recordingHook) Flush() error {
+	h.flushes++
+	return nil
+}
+
+func TestSpoolHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hook := &recordingHook{}
+	h, err := NewSpoolHook(hook, SpoolConfig{Dir: dir})
+	assert.NoError(t, err)
+	entry := logrus.WithFields(logrus.Fields{
+		"service": "api",
+		"count":   3,
+		"cause":   errors.New("timeout"),
+	}).WithError(errors.New("boom"))
+	entry.Level = logrus.ErrorLevel
+	entry.Time = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry.Message = "request failed"
+	assert.NoError(t, h.Fire(entry))
+	assert.NoError(t, h.Close())
+
+	if assert.Len(t, hook.entries, 1) {
+		replayed := hook.entries[0]
+		assert.Equal(t, logrus.ErrorLevel, replayed.Level)
+		assert.Equal(t, "request failed", replayed.Message)
+		assert.True(t, entry.Time.Equal(replayed.Time))
+		assert.Equal(t, "api", replayed.Data["service"])
+		assert.Equal(t, "3", replayed.Data["count"].(interface{ String() string }).String())
+		assert.Equal(t, "timeout", replayed.Data["cause"])
+		assert.EqualError(t, replayed.Data[logrus.ErrorKey].(error), "boom")
+	}
+	assert.True(t, hook.flushes > 0)
+}
+
+// rejectingWriter rejects the records containing bad with a permanent error,
+// and fails the others while it is down.
+type rejectingWriter struct {
+	flakyWriter
+	bad      string
+	rejected int
+}
+
+func (w *rejectingWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.bad) {
+		w.mu.Lock()
+		w.rejected++
+		w.mu.Unlock()
+		return 0, &StatusError{StatusCode: 400, Body: "bad record"}
+	}
+	return w.flakyWriter.Write(p)
+}
+
+func TestSpoolPermanentFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := &rejectingWriter{bad: "bad"}
+	w, err := NewSpoolWriter(out, SpoolConfig{Dir: dir, RetryInterval: time.Millisecond, MaxAttempts: 3})
+	assert.NoError(t, err)
+	out.setUp(true)
+	for _, line := range []string{"a\n", "bad\n", "c\n"} {
+		w.Write([]byte(line))
+	}
+	// the records before the rejected one aren't delivered again
+	assert.EqualError(t, w.Flush(), "unexpected status 400: bad record")
+	assert.EqualError(t, w.Flush(), "unexpected status 400: bad record")
+	out.setUp(false)
+	assert.EqualError(t, w.Flush(), "collector down")
+	out.setUp(true)
+	w.Write([]byte("d\n"))
+	assert.NoError(t, w.Flush())
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"a\n", "c\n", "d\n"}, out.written())
+	assert.Equal(t, 3, out.rejected)
+}
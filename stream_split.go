@@ -0,0 +1,154 @@
+package epiclogger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StreamSplitConfig configures the split of a logger output between stdout
+// and stderr.
+type StreamSplitConfig struct {
+	// StderrLevels are the levels written to Stderr, warning and above when
+	// nil. The other levels are written to Stdout.
+	StderrLevels []log.Level
+
+	// Formatter formats the entries, the logger's formatter when nil.
+	Formatter log.Formatter
+
+	// Stdout and Stderr default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// streamSplitHook writes the entries to stdout or stderr after their level.
+// Entries are written as they are logged, one at a time, so they keep their
+// order as long as the reader of both streams does.
+type streamSplitHook struct {
+	mu       sync.Mutex
+	stdout   *splitStream
+	stderr   *splitStream
+	toStderr map[log.Level]bool
+}
+
+// splitStream is one of the outputs of a streamSplitHook. The entries are
+// formatted as if logged by logger, whose Out is the stream, so that the text
+// formatters only use colors when the stream itself is a terminal.
+type splitStream struct {
+	formatter log.Formatter
+	logger    *log.Logger
+}
+
+func newSplitStream(formatter log.Formatter, out io.Writer) *splitStream {
+	formatter = streamFormatter(formatter)
+	return &splitStream{
+		formatter: formatter,
+		logger:    &log.Logger{Out: out, Formatter: formatter},
+	}
+}
+
+// streamFormatter returns a copy of the text formatters, which check once
+// whether their output is a terminal and so can't be shared by both streams.
+func streamFormatter(formatter log.Formatter) log.Formatter {
+	switch f := formatter.(type) {
+	case *TextFormatter:
+		return &TextFormatter{
+			ForceColors:      f.ForceColors,
+			DisableColors:    f.DisableColors,
+			DisableTimestamp: f.DisableTimestamp,
+			FullTimestamp:    f.FullTimestamp,
+			TimestampFormat:  f.TimestampFormat,
+			DisableSorting:   f.DisableSorting,
+			QuoteEmptyFields: f.QuoteEmptyFields,
+			Encoder:          f.Encoder,
+			FieldMap:         f.FieldMap,
+			ClashPolicy:      f.ClashPolicy,
+			ClashPrefix:      f.ClashPrefix,
+		}
+	case *log.TextFormatter:
+		return &log.TextFormatter{
+			ForceColors:      f.ForceColors,
+			DisableColors:    f.DisableColors,
+			DisableTimestamp: f.DisableTimestamp,
+			FullTimestamp:    f.FullTimestamp,
+			TimestampFormat:  f.TimestampFormat,
+			DisableSorting:   f.DisableSorting,
+			QuoteEmptyFields: f.QuoteEmptyFields,
+		}
+	}
+	return formatter
+}
+
+// format formats a copy of entry, the formatters may change its fields which
+// the hooks fired after this one must still see unchanged.
+func (s *splitStream) format(entry *log.Entry) ([]byte, error) {
+	copied := copyEntry(entry)
+	copied.Logger = s.logger
+	return s.formatter.Format(copied)
+}
+
+// SplitStreams writes the entries of the standard logger at the
+// config.StderrLevels to stderr, and the others to stdout. Set the formatter
+// first, or set config.Formatter.
+func SplitStreams(config StreamSplitConfig) {
+	splitStreams(baseLogger.Logger, config)
+}
+
+// NewSplitEpicLogger returns a logger writing the entries at the
+// config.StderrLevels to stderr, and the others to stdout.
+func NewSplitEpicLogger(config StreamSplitConfig) EpicLogger {
+	l := log.New()
+	splitStreams(l, config)
+	return EpicLogger{Entry: log.NewEntry(l)}
+}
+
+func splitStreams(l *log.Logger, config StreamSplitConfig) {
+	if config.StderrLevels == nil {
+		config.StderrLevels = LevelsFrom(log.WarnLevel)
+	}
+	if config.Formatter == nil {
+		config.Formatter = l.Formatter
+	}
+	if config.Stdout == nil {
+		config.Stdout = os.Stdout
+	}
+	if config.Stderr == nil {
+		config.Stderr = os.Stderr
+	}
+	hook := &streamSplitHook{
+		stdout:   newSplitStream(config.Formatter, config.Stdout),
+		stderr:   newSplitStream(config.Formatter, config.Stderr),
+		toStderr: map[log.Level]bool{},
+	}
+	for _, level := range config.StderrLevels {
+		hook.toStderr[level] = true
+	}
+	// the hook writes the entries, logrus writes nothing
+	l.Out = ioutil.Discard
+	l.Formatter = discardFormatter{}
+	l.Hooks.Add(hook)
+}
+
+// Levels implements logrus.Hook.
+func (h *streamSplitHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *streamSplitHook) Fire(entry *log.Entry) error {
+	stream := h.stdout
+	if h.toStderr[entry.Level] {
+		stream = h.stderr
+	}
+	b, err := stream.format(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = stream.logger.Out.Write(b)
+	return err
+}
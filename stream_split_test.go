@@ -0,0 +1,79 @@
+package epiclogger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	logger := NewSplitEpicLogger(StreamSplitConfig{
+		Formatter: &logrus.TextFormatter{DisableTimestamp: true},
+		Stdout:    &stdout,
+		Stderr:    &stderr,
+	})
+	logger.Logger.SetLevel(logrus.DebugLevel)
+
+	logger.Debug("debugging")
+	logger.Info("started")
+	logger.Warn("slow")
+	logger.Errorf("failed")
+	assert.Equal(t, "level=debug msg=debugging\nlevel=info msg=started\n", stdout.String())
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "level=warning msg=slow", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "level=error msg=failed "))
+	}
+}
+
+func TestSplitStreamsLevels(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	logger := NewSplitEpicLogger(StreamSplitConfig{
+		StderrLevels: LevelsFrom(logrus.ErrorLevel),
+		Formatter:    &EpicFormatter{},
+		Stdout:       &stdout,
+		Stderr:       &stderr,
+	})
+
+	logger.Warn("slow")
+	logger.Error("failed")
+	assert.Contains(t, stdout.String(), `"message":"slow"`)
+	assert.Contains(t, stderr.String(), `"message":"failed"`)
+	assert.NotContains(t, stdout.String(), "failed")
+}
+
+func TestSplitStreamsKeepsEntry(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := NewSplitEpicLogger(StreamSplitConfig{
+		Formatter: &TextFormatter{DisableTimestamp: true},
+		Stdout:    &stdout,
+	})
+	hook := &recordingHook{}
+	logger.Logger.Hooks.Add(hook)
+
+	logger.WithField("msg", "clash").Info("started")
+	assert.Contains(t, stdout.String(), "fields.msg=clash")
+	if assert.Len(t, hook.entries, 1) {
+		assert.Equal(t, logrus.Fields{"msg": "clash"}, hook.entries[0].Data)
+	}
+}
+
+func TestSplitStreamsTerminal(t *testing.T) {
+	formatter := &TextFormatter{}
+	var stdout, stderr bytes.Buffer
+	logger := NewSplitEpicLogger(StreamSplitConfig{
+		Formatter: formatter,
+		Stdout:    &stdout,
+		Stderr:    &stderr,
+	})
+	hook := logger.Logger.Hooks[logrus.InfoLevel][0].(*streamSplitHook)
+
+	assert.Equal(t, &stdout, hook.stdout.logger.Out)
+	assert.Equal(t, &stderr, hook.stderr.logger.Out)
+	assert.False(t, hook.stdout.formatter == hook.stderr.formatter, "text formatters are per stream")
+	assert.False(t, hook.stdout.formatter == logrus.Formatter(formatter))
+}
@@ -0,0 +1,381 @@
+package epiclogger
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSyslogFacility is the user-level messages facility.
+const DefaultSyslogFacility = 1
+
+// DefaultStructuredDataID is the SD-ID of the element holding the fields.
+// 32473 is the private enterprise number reserved for documentation.
+const DefaultStructuredDataID = "fields@32473"
+
+// DefaultSyslogDatagramSize is the largest message sent over UDP and unixgram
+// sockets, longer messages are truncated. RFC 5426 recommends collectors to
+// accept at least 2048 bytes.
+const DefaultSyslogDatagramSize = 2048
+
+const nilValue = "-"
+
+// SyslogFormatter formats entries as RFC 5424 syslog messages, with the
+// fields in a structured data element. Use it with a SyslogWriter as the
+// logger output, or on its own to write to a file read by a syslog agent.
+type SyslogFormatter struct {
+	// Facility is the syslog facility code, DefaultSyslogFacility when zero.
+	Facility int
+
+	// Hostname, AppName, ProcID and MsgID fill the message header. They
+	// default to the host name, the service field or program name, the pid
+	// and NILVALUE.
+	Hostname string
+	AppName  string
+	ProcID   string
+	MsgID    string
+
+	// StructuredDataID is the SD-ID of the fields, DefaultStructuredDataID
+	// when empty.
+	StructuredDataID string
+
+	// Formatter collects the fields like the JSON output does.
+	Formatter *EpicFormatter
+
+	once     sync.Once
+	hostname string
+	appName  string
+	procID   string
+}
+
+// syslogSeverity maps getSeverity to the syslog severities.
+func syslogSeverity(level log.Level) int {
+	switch getSeverity(level) {
+	case "CRITICAL":
+		return 2
+	case "ERROR":
+		return 3
+	case "WARNING":
+		return 4
+	case "INFO":
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (f *SyslogFormatter) init() {
+	f.hostname = f.Hostname
+	if f.hostname == "" {
+		f.hostname, _ = os.Hostname()
+	}
+	f.appName = f.AppName
+	if f.appName == "" {
+		f.appName = filepath.Base(os.Args[0])
+	}
+	f.procID = f.ProcID
+	if f.procID == "" {
+		f.procID = strconv.Itoa(os.Getpid())
+	}
+}
+
+// Format the log entry. Implements logrus.Formatter.
+func (f *SyslogFormatter) Format(entry *log.Entry) ([]byte, error) {
+	f.once.Do(f.init)
+	formatter := f.Formatter
+	if formatter == nil {
+		formatter = &EpicFormatter{}
+	}
+	data, httpReq, err := formatter.collectFields(entry)
+	if err != nil {
+		return nil, err
+	}
+	if httpReq != nil {
+		data["httpRequest"] = httpReq
+	}
+
+	facility := f.Facility
+	if facility == 0 {
+		facility = DefaultSyslogFacility
+	}
+	appName := f.appName
+	if service, ok := data["service"].(string); ok && f.AppName == "" {
+		appName = service
+	}
+	sdID := f.StructuredDataID
+	if sdID == "" {
+		sdID = DefaultStructuredDataID
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<%d>1 %s %s %s %s %s ",
+		facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(f.hostname, 255),
+		headerField(appName, 48),
+		headerField(f.procID, 128),
+		headerField(f.MsgID, 32),
+	)
+	writeStructuredData(b, sdID, data)
+	if entry.Message != "" {
+		b.WriteByte(' ')
+		b.WriteString(entry.Message)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// headerField returns value restricted to the printable ASCII characters and
+// length allowed in a header field.
+func headerField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if value == "" {
+		return nilValue
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	return value
+}
+
+// writeStructuredData writes data as a single SD-ELEMENT with the keys in
+// order, or NILVALUE when there are no fields.
+func writeStructuredData(b *bytes.Buffer, id string, data map[string]interface{}) {
+	if len(data) == 0 {
+		b.WriteString(nilValue)
+		return
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteByte('[')
+	b.WriteString(id)
+	for _, k := range keys {
+		name := paramName(k)
+		if name == "" {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(paramValueEscaper.Replace(paramValue(data[k])))
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+}
+
+// paramName drops the characters not allowed in an SD-NAME.
+func paramName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' || r == ' ' {
+			return -1
+		}
+		return r
+	}, key)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+var paramValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func paramValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case fmt.Stringer:
+		return x.String()
+	case json.RawMessage:
+		return string(x)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// SyslogConfig configures a SyslogWriter.
+type SyslogConfig struct {
+	// Network is "udp", "tcp", "tls", "unix" or "unixgram". Messages are
+	// framed with octet counting on the stream networks.
+	Network string
+
+	// Address of the collector, a host:port or a socket path.
+	Address string
+
+	// TLSConfig is used by the "tls" network.
+	TLSConfig *tls.Config
+
+	// DialTimeout and WriteTimeout bound the network calls, 5s when zero.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxDatagramSize is the largest message sent over udp and unixgram,
+	// DefaultSyslogDatagramSize when zero.
+	MaxDatagramSize int
+
+	// FlushInterval bounds how long messages wait before being written,
+	// 1s when zero.
+	FlushInterval time.Duration
+
+	// QueueSize is the number of messages kept in memory while the collector
+	// is unreachable, new messages are dropped once it is full.
+	QueueSize int
+
+	// MaxRetries and RetryBackoff control the reconnections before a batch
+	// of messages is dropped.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// SyslogWriter writes the messages of a SyslogFormatter to a syslog
+// collector. Writes never block: messages are queued and sent in the
+// background, reconnecting when the connection is lost. Messages of a batch
+// being written when the connection broke can be sent twice.
+type SyslogWriter struct {
+	config SyslogConfig
+	stream bool
+	retry  *retryPolicy
+	batchSink
+
+	conn net.Conn
+}
+
+// NewSyslogWriter returns a writer sending to the collector of config. The
+// collector doesn't have to be up yet.
+func NewSyslogWriter(config SyslogConfig) (*SyslogWriter, error) {
+	w := &SyslogWriter{config: config}
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6", "tls", "unix":
+		w.stream = true
+	case "udp", "udp4", "udp6", "unixgram":
+	default:
+		return nil, fmt.Errorf("epiclogger: unsupported syslog network %q", config.Network)
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("epiclogger: a syslog Address is required")
+	}
+	w.config.DialTimeout = durationOr(config.DialTimeout, 5*time.Second)
+	w.config.WriteTimeout = durationOr(config.WriteTimeout, 5*time.Second)
+	w.config.MaxDatagramSize = limit(config.MaxDatagramSize, DefaultSyslogDatagramSize)
+	w.retry = newRetryPolicy(config.MaxRetries, config.RetryBackoff)
+	w.start("syslog", newBatchOptions(0, 64*1024, durationOr(config.FlushInterval, time.Second), config.QueueSize), w.send)
+	return w, nil
+}
+
+// Write queues one message. The trailing newline added by SyslogFormatter is
+// dropped, framing is left to the transport.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	msg := make([]byte, len(p))
+	copy(msg, p)
+	msg = bytes.TrimSuffix(msg, []byte("\n"))
+	w.add(msg, len(msg))
+	return len(p), nil
+}
+
+// Close writes the queued messages and closes the connection.
+func (w *SyslogWriter) Close() error {
+	w.batchSink.Close()
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
+
+// connError makes connection failures retryable, reconnecting may fix them.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string   { return e.err.Error() }
+func (e *connError) Temporary() bool { return true }
+
+func (w *SyslogWriter) dial() (net.Conn, error) {
+	if w.config.Network == "tls" {
+		dialer := &net.Dialer{Timeout: w.config.DialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", w.config.Address, w.config.TLSConfig)
+	}
+	return net.DialTimeout(w.config.Network, w.config.Address, w.config.DialTimeout)
+}
+
+// write sends the messages on the current connection, dialing a new one
+// when there is none.
+func (w *SyslogWriter) write(messages [][]byte) error {
+	if w.conn == nil {
+		conn, err := w.dial()
+		if err != nil {
+			return &connError{err}
+		}
+		w.conn = conn
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.config.WriteTimeout))
+	var err error
+	if w.stream {
+		b := &bytes.Buffer{}
+		for _, msg := range messages {
+			b.WriteString(strconv.Itoa(len(msg)))
+			b.WriteByte(' ')
+			b.Write(msg)
+		}
+		_, err = w.conn.Write(b.Bytes())
+	} else {
+		for _, msg := range messages {
+			if _, err = w.conn.Write(truncateDatagram(msg, w.config.MaxDatagramSize)); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return &connError{err}
+	}
+	return nil
+}
+
+func (w *SyslogWriter) send(items []interface{}) error {
+	messages := make([][]byte, len(items))
+	for i, item := range items {
+		messages[i] = item.([]byte)
+	}
+	return w.retry.do(func() error {
+		return w.write(messages)
+	})
+}
+
+// truncateDatagram cuts msg to max bytes without splitting a UTF-8 sequence.
+func truncateDatagram(msg []byte, max int) []byte {
+	if max <= 0 || len(msg) <= max {
+		return msg
+	}
+	msg = msg[:max]
+	for i := 0; i < utf8.UTFMax && len(msg) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(msg); r != utf8.RuneError || size != 1 {
+			break
+		}
+		msg = msg[:len(msg)-1]
+	}
+	return msg
+}
@@ -0,0 +1,103 @@
+package epiclogger
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogFormatter(t *testing.T) {
+	f := &SyslogFormatter{Hostname: "host", AppName: "app", ProcID: "42"}
+	entry := logrus.WithFields(logrus.Fields{"user": "jane", "quote": `say "hi"]`})
+	entry.Level = logrus.WarnLevel
+	entry.Time = time.Date(2018, 1, 2, 3, 4, 5, 6000, time.UTC)
+	entry.Message = "disk almost full"
+
+	b, err := f.Format(entry)
+	assert.NoError(t, err)
+	assert.Equal(t, `<12>1 2018-01-02T03:04:05.000006Z host app 42 - [fields@32473 quote="say \"hi\"\]" user="jane"] disk almost full`+"\n", string(b))
+
+	entry = logrus.NewEntry(logrus.StandardLogger())
+	entry.Level = logrus.FatalLevel
+	b, err = f.Format(entry)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "<10>1 "))
+	assert.True(t, strings.HasSuffix(string(b), " host app 42 - -\n"))
+}
+
+// readOctetCounted reads one octet-counting framed message.
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func TestSyslogWriterTCPReconnects(t *testing.T) {
+	// reserve an address, the collector only starts after the first write
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	w, err := NewSyslogWriter(SyslogConfig{Network: "tcp", Address: address, RetryBackoff: 10 * time.Millisecond, FlushInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	w.Write([]byte("<14>1 - - - - - - first\n"))
+	w.Write([]byte("<14>1 - - - - - - second\n"))
+	time.Sleep(30 * time.Millisecond)
+
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("address reused meanwhile:", err)
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"<14>1 - - - - - - first", "<14>1 - - - - - - second"} {
+		msg, err := readOctetCounted(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+	assert.NoError(t, w.Close())
+}
+
+func TestSyslogWriterUDPSizeLimit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	w, err := NewSyslogWriter(SyslogConfig{Network: "udp", Address: conn.LocalAddr().String(), MaxDatagramSize: 10})
+	assert.NoError(t, err)
+	w.Write([]byte("<14>1 hhhé\n"))
+	assert.NoError(t, w.Close())
+
+	buf := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	// the message is cut before the é that doesn't fit
+	assert.Equal(t, "<14>1 hhh", string(buf[:n]))
+}
+
+func TestSyslogWriterInvalidConfig(t *testing.T) {
+	_, err := NewSyslogWriter(SyslogConfig{Network: "http", Address: "localhost:514"})
+	assert.Error(t, err)
+	_, err = NewSyslogWriter(SyslogConfig{Network: "udp"})
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package epiclogger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -60,6 +61,21 @@ type TextFormatter struct {
 	// QuoteEmptyFields will wrap empty fields in quotes if true
 	QuoteEmptyFields bool
 
+	// Encoder renders struct, map and slice field values. Uses the same
+	// FieldEncoder as EpicFormatter when nil.
+	Encoder *FieldEncoder
+
+	// FieldMap renames the time, level (FieldKeySeverity) and msg
+	// (FieldKeyMessage) keys.
+	FieldMap FieldMap
+
+	// ClashPolicy decides what happens to user fields named like time, level
+	// or msg. ClashPrefix by default.
+	ClashPolicy ClashPolicy
+
+	// ClashPrefix is used by the ClashPrefix policy, DefaultClashPrefix when empty.
+	ClashPrefix string
+
 	// Whether the logger's out is to a terminal
 	isTerminal bool
 
@@ -84,6 +100,13 @@ func (f *TextFormatter) checkIfTerminal(w io.Writer) bool {
 // Format renders a single log entry
 func (f *TextFormatter) Format(entry *log.Entry) ([]byte, error) {
 	var b *bytes.Buffer
+	timeKey := f.FieldMap.resolve(FieldKeyTime)
+	levelKey := f.FieldMap.resolveOr(FieldKeySeverity, "level")
+	msgKey := f.FieldMap.resolveOr(FieldKeyMessage, "msg")
+	if err := resolveFieldClashes(entry.Data, []string{timeKey, levelKey, msgKey}, f.ClashPolicy, f.ClashPrefix); err != nil {
+		return nil, err
+	}
+
 	caller := strings.Split(fmt.Sprint(entry.Data["caller"]), "/")
 	entry.Data["caller"] = caller[len(caller)-1]
 	keys := make([]string, 0, len(entry.Data))
@@ -102,8 +125,6 @@ func (f *TextFormatter) Format(entry *log.Entry) ([]byte, error) {
 		b = &bytes.Buffer{}
 	}
 
-	prefixFieldClashes(entry.Data)
-
 	f.Do(func() { f.init(entry) })
 
 	isColored := (f.ForceColors || f.isTerminal) && !f.DisableColors
@@ -116,11 +137,11 @@ func (f *TextFormatter) Format(entry *log.Entry) ([]byte, error) {
 		f.printColored(b, entry, keys, timestampFormat)
 	} else {
 		if !f.DisableTimestamp {
-			f.appendKeyValue(b, "time", entry.Time.Format(timestampFormat))
+			f.appendKeyValue(b, timeKey, entry.Time.Format(timestampFormat))
 		}
-		f.appendKeyValue(b, "level", entry.Level.String())
+		f.appendKeyValue(b, levelKey, entry.Level.String())
 		if entry.Message != "" {
-			f.appendKeyValue(b, "msg", entry.Message)
+			f.appendKeyValue(b, msgKey, entry.Message)
 		}
 		for _, key := range keys {
 			f.appendKeyValue(b, key, entry.Data[key])
@@ -188,10 +209,17 @@ func (f *TextFormatter) appendKeyValue(b *bytes.Buffer, key string, value interf
 	f.appendValue(b, value)
 }
 
+func (f *TextFormatter) fieldEncoder() *FieldEncoder {
+	if f.Encoder != nil {
+		return f.Encoder
+	}
+	return defaultFieldEncoder
+}
+
 func (f *TextFormatter) appendValue(b *bytes.Buffer, value interface{}) {
 	stringVal, ok := value.(string)
 	if !ok {
-		stringVal = fmt.Sprint(value)
+		stringVal = f.stringify(value)
 	}
 	if !f.needsQuoting(stringVal) {
 		b.WriteString(stringVal)
@@ -199,3 +227,19 @@ func (f *TextFormatter) appendValue(b *bytes.Buffer, value interface{}) {
 		b.WriteString(fmt.Sprintf("%q", stringVal))
 	}
 }
+
+// stringify renders composite values as JSON so nested structs read the same
+// as they do in EpicFormatter output.
+func (f *TextFormatter) stringify(value interface{}) string {
+	switch encoded := f.fieldEncoder().Encode(value).(type) {
+	case map[string]interface{}, []interface{}:
+		if b, err := json.Marshal(encoded); err == nil {
+			return string(b)
+		}
+	case json.RawMessage:
+		return string(encoded)
+	case string:
+		return encoded
+	}
+	return fmt.Sprint(value)
+}
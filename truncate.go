@@ -0,0 +1,150 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/facebookgo/stack"
+)
+
+// Cloud Logging rejects entries over 256KB, leave some room for the metadata
+// fluentd adds to every line.
+const (
+	DefaultMaxEntryBytes = 250 * 1024
+	DefaultMaxFieldBytes = 64 * 1024
+	DefaultMaxArrayLen   = 1000
+)
+
+const truncatedKey = "truncated"
+
+type truncator struct {
+	maxFieldBytes int
+	maxArrayLen   int
+	// messageKey is the key of the message, as renamed by the FieldMap.
+	messageKey string
+	// untruncatable are the keys never shrunk to fit an entry into its
+	// budget.
+	untruncatable []string
+	truncated     bool
+}
+
+func truncatedMarker(n int) string {
+	return fmt.Sprintf("…(truncated %d bytes)", n)
+}
+
+// truncate enforces the per-field and array budgets on v. Stacks, and
+// messages that carry them on error entries, lose their middle so both the
+// error and the outermost frames are kept.
+func (t *truncator) truncate(key string, v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		if key == "stack" || key == t.messageKey {
+			return t.truncateMiddle(x, t.maxFieldBytes)
+		}
+		return t.truncateString(x, t.maxFieldBytes)
+	case stack.Stack:
+		if s := x.String(); t.maxFieldBytes > 0 && len(s) > t.maxFieldBytes {
+			return t.truncateMiddle(s, t.maxFieldBytes)
+		}
+	case map[string]interface{}:
+		for k, value := range x {
+			x[k] = t.truncate(k, value)
+		}
+	case []interface{}:
+		if t.maxArrayLen > 0 && len(x) > t.maxArrayLen {
+			t.truncated = true
+			x = append(x[:t.maxArrayLen:t.maxArrayLen], fmt.Sprintf("…(truncated %d items)", len(x)-t.maxArrayLen))
+		}
+		for i, value := range x {
+			x[i] = t.truncate(key, value)
+		}
+		return x
+	}
+	return v
+}
+
+func (t *truncator) truncateString(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	t.truncated = true
+	cut := runeBoundary(s, max)
+	return s[:cut] + truncatedMarker(len(s)-cut)
+}
+
+func (t *truncator) truncateMiddle(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	t.truncated = true
+	head := runeBoundary(s, max/2)
+	tail := len(s) - (max - head)
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+	return s[:head] + "\n" + truncatedMarker(tail-head) + "\n" + s[tail:]
+}
+
+// shrink cuts down the largest field of payload by roughly excess bytes.
+// It returns false when there is nothing left that can be shrunk.
+func (t *truncator) shrink(payload map[string]interface{}, excess int) bool {
+	var largestKey string
+	var largestSize int
+	for k, v := range payload {
+		if contains(k, t.untruncatable) {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if len(b) > largestSize {
+			largestKey, largestSize = k, len(b)
+		}
+	}
+	marker := truncatedMarker(largestSize)
+	if largestSize <= len(marker)+2 {
+		return false
+	}
+
+	t.truncated = true
+	if s, ok := payload[largestKey].(string); ok {
+		cut := t.truncateString
+		if largestKey == t.messageKey {
+			cut = t.truncateMiddle
+		}
+		if shrunk, ok := cutToJSONSize(s, largestSize-excess, cut); ok {
+			payload[largestKey] = shrunk
+			return true
+		}
+	}
+	payload[largestKey] = marker
+	return true
+}
+
+// cutToJSONSize returns the longest cut of s whose JSON encoding fits in max
+// bytes. Escaping can make the JSON of s several times longer than s, so the
+// cut is searched for on the encoded size.
+func cutToJSONSize(s string, max int, cut func(string, int) string) (string, bool) {
+	var best string
+	found := false
+	for lo, hi := 1, len(s)-1; lo <= hi; {
+		mid := (lo + hi) / 2
+		shrunk := cut(s, mid)
+		if b, err := json.Marshal(shrunk); err == nil && len(b) <= max {
+			best, found = shrunk, true
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best, found
+}
+
+func runeBoundary(s string, i int) int {
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,125 @@
+package epiclogger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func formatFields(t *testing.T, formatter *EpicFormatter, fields map[string]interface{}) (map[string]interface{}, int) {
+	b, err := formatter.Format(epicLogger.WithFields(fields).Entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	entry := make(map[string]interface{})
+	err = json.Unmarshal(b, &entry)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	return entry, len(b)
+}
+
+func TestLongFieldTruncated(t *testing.T) {
+	entry, _ := formatFields(t, &EpicFormatter{MaxFieldBytes: 10}, map[string]interface{}{"long": strings.Repeat("a", 30)})
+
+	if entry["long"] != "aaaaaaaaaa…(truncated 20 bytes)" {
+		t.Fatal("long field not truncated, was: ", entry["long"])
+	}
+	if entry["truncated"] != true {
+		t.Fatal("truncated flag not set")
+	}
+}
+
+func TestShortFieldsUntouched(t *testing.T) {
+	entry, _ := formatFields(t, &EpicFormatter{}, map[string]interface{}{"short": "abc"})
+
+	if entry["short"] != "abc" {
+		t.Fatal("short field changed, was: ", entry["short"])
+	}
+	if entry["truncated"] != nil {
+		t.Fatal("truncated flag set")
+	}
+}
+
+func TestLargeArrayCapped(t *testing.T) {
+	entry, _ := formatFields(t, &EpicFormatter{MaxArrayLen: 2}, map[string]interface{}{"list": []int{1, 2, 3, 4}})
+
+	list := entry["list"].([]interface{})
+	if len(list) != 3 || list[2] != "…(truncated 2 items)" {
+		t.Fatal("array not capped, was: ", list)
+	}
+}
+
+func TestStackTrimmedFromMiddle(t *testing.T) {
+	stack := "head\n" + strings.Repeat("frame\n", 100) + "tail"
+	entry, _ := formatFields(t, &EpicFormatter{MaxFieldBytes: 20}, map[string]interface{}{"stack": stack})
+
+	// error entries carry the stack in the message
+	trimmed := entry["message"].(string)
+	if !strings.HasPrefix(trimmed, "head") || !strings.HasSuffix(trimmed, "tail") || !strings.Contains(trimmed, "truncated") {
+		t.Fatal("stack not trimmed from the middle, was: ", trimmed)
+	}
+}
+
+func TestRenamedKeysTruncated(t *testing.T) {
+	formatter := &EpicFormatter{
+		MaxEntryBytes: 512,
+		FieldMap:      FieldMap{FieldKeyMessage: "@message", FieldKeyTime: "@timestamp"},
+	}
+	entry := epicLogger.WithField("big", strings.Repeat("b", 300)).Entry
+	entry.Level = logrus.InfoLevel
+	entry.Message = "head\n" + strings.Repeat("line\n", 100) + "tail"
+	b, err := formatter.Format(entry)
+	if err != nil {
+		t.Fatal("Unable to format entry: ", err)
+	}
+
+	formatted := make(map[string]interface{})
+	err = json.Unmarshal(b, &formatted)
+	if err != nil {
+		t.Fatal("Unable to unmarshal formatted entry: ", err)
+	}
+	if len(b) > 512 {
+		t.Fatal("entry over budget: ", len(b))
+	}
+	trimmed := formatted["@message"].(string)
+	if !strings.HasPrefix(trimmed, "head") || !strings.HasSuffix(trimmed, "tail") {
+		t.Fatal("renamed message not trimmed from the middle, was: ", trimmed)
+	}
+	if formatted["@timestamp"] != "0001-01-01T00:00:00Z" {
+		t.Fatal("renamed time field shrunk, was: ", formatted["@timestamp"])
+	}
+}
+
+func TestEntryFitsBudget(t *testing.T) {
+	entry, size := formatFields(t, &EpicFormatter{MaxEntryBytes: 1024}, map[string]interface{}{
+		"big":    strings.Repeat("b", 4096),
+		"bigger": strings.Repeat("c", 8192),
+	})
+
+	if size > 1024 {
+		t.Fatal("entry over budget: ", size)
+	}
+	if entry["truncated"] != true {
+		t.Fatal("truncated flag not set")
+	}
+	if entry["serviceContext"].(map[string]interface{})["service"] != "test-service" {
+		t.Fatal("small fields lost, serviceContext was: ", entry["serviceContext"])
+	}
+}
+
+func TestEscapedEntryFitsBudget(t *testing.T) {
+	entry, size := formatFields(t, &EpicFormatter{MaxEntryBytes: 1024}, map[string]interface{}{
+		"quotes": strings.Repeat(`"<\`, 4096),
+	})
+
+	if size > 1024 {
+		t.Fatal("entry over budget: ", size)
+	}
+	if !strings.HasPrefix(entry["quotes"].(string), `"<\"<\`) {
+		t.Fatal("escaped field not shrunk but replaced, was: ", entry["quotes"])
+	}
+}